@@ -1,13 +1,22 @@
 package nnfast
 
 import (
+	"cmp"
 	"math"
 	"math/rand"
-	"sort"
+	"runtime"
+	"slices"
 	"sync"
 )
 
-var NumThreads = 8
+// NumThreads is size of default pool, it is read once when pool is started on first use.
+// Models can have own pools, see Model.SetThreads in llama2.
+var NumThreads = runtime.GOMAXPROCS(0)
+
+var defaultPool = sync.OnceValue(func() *Pool { return NewPool(NumThreads) })
+
+// DefaultPool is shared by MatMul and everyone without own pool, it should not be closed.
+func DefaultPool() *Pool { return defaultPool() }
 
 func Acc[T float32 | float64](a, b []T) {
 	for i := range a {
@@ -70,27 +79,65 @@ func MatMulUnroll4[T float32 | float64](xout, x, w []T) {
 	}
 }
 
-// MatMulParallel chunks horizontally across cache lines and parallelizes
-func MatMulParallel[T float32 | float64](xout, x, w []T) {
-	n, m := len(xout), len(x)
-	if n < NumThreads {
-		MatMulUnroll4(xout, x, w)
-		return
+// MatMulParallel chunks horizontally across rows and runs chunks on workers of default pool.
+func MatMulParallel[T float32 | float64](xout, x, w []T) { MatMulPool(defaultPool(), xout, x, w) }
+
+// MatMulPool is MatMulParallel on workers of given pool.
+// It allocates task for each call, use MatMulTask to reuse it.
+func MatMulPool[T float32 | float64](pool *Pool, xout, x, w []T) {
+	var task MatMulTask[T]
+	task.MatMul(pool, x, xout, w)
+}
+
+// MatMulBatch multiplies W by each of batch vectors, which is matrix-matrix multiplication.
+// W (d,n) @ x (batch,n) -> xout (batch,d)
+// Results are same as of MatMulUnroll4 for each vector, since each dot product is summed in the same order.
+func MatMulBatch[T float32 | float64](xout, x, w []T, batch int) {
+	n := len(x) / batch
+	matMulBatch(xout, len(xout)/batch, x, w, batch, n, len(w)/n)
+}
+
+// matMulBatch computes rows of xout with stride ldo, in blocks of 2 rows by 4 vectors,
+// so that each loaded value of W is used 4 times and of x 2 times from registers.
+// Larger blocks do not fit into registers of amd64.
+func matMulBatch[T float32 | float64](xout []T, ldo int, x, w []T, batch, n, rows int) {
+	r := 0
+	for ; r+2 <= rows; r += 2 {
+		w0, w1 := w[r*n:(r+1)*n], w[(r+1)*n:(r+2)*n]
+		b := 0
+		for ; b+4 <= batch; b += 4 {
+			x0, x1, x2, x3 := x[b*n:(b+1)*n], x[(b+1)*n:(b+2)*n], x[(b+2)*n:(b+3)*n], x[(b+3)*n:(b+4)*n]
+			w1, x0, x1, x2, x3 := w1[:len(w0)], x0[:len(w0)], x1[:len(w0)], x2[:len(w0)], x3[:len(w0)]
+			var s00, s01, s02, s03, s10, s11, s12, s13 T
+			for j, a0 := range w0 {
+				a1 := w1[j]
+				v0, v1, v2, v3 := x0[j], x1[j], x2[j], x3[j]
+				s00 += a0 * v0
+				s01 += a0 * v1
+				s02 += a0 * v2
+				s03 += a0 * v3
+				s10 += a1 * v0
+				s11 += a1 * v1
+				s12 += a1 * v2
+				s13 += a1 * v3
+			}
+			xout[b*ldo+r], xout[b*ldo+r+1] = s00, s10
+			xout[(b+1)*ldo+r], xout[(b+1)*ldo+r+1] = s01, s11
+			xout[(b+2)*ldo+r], xout[(b+2)*ldo+r+1] = s02, s12
+			xout[(b+3)*ldo+r], xout[(b+3)*ldo+r+1] = s03, s13
+		}
+		for ; b < batch; b++ {
+			MatMulUnroll4(xout[b*ldo+r:b*ldo+r+2], x[b*n:(b+1)*n], w[r*n:(r+2)*n])
+		}
 	}
-	var wg sync.WaitGroup
-	wg.Add(NumThreads)
-	for i := 0; i < NumThreads; i++ {
-		rowStart := i * n / NumThreads
-		rowEnd := (i + 1) * n / NumThreads
-		if i == NumThreads-1 {
-			rowEnd = n
+	if r < rows {
+		for b := 0; b < batch; b++ {
+			MatMulUnroll4(xout[b*ldo+r:b*ldo+r+1], x[b*n:(b+1)*n], w[r*n:(r+1)*n])
 		}
-		go func(rowStart, rowEnd int) { MatMulUnroll4(xout[rowStart:rowEnd], x, w[m*rowStart:m*rowEnd]); wg.Done() }(rowStart, rowEnd)
 	}
-	wg.Wait()
 }
 
-// MatMul uses multiple optimizations
+// MatMul uses multiple optimizations, it runs on default pool of NumThreads workers
 func MatMul[T float32 | float64](xout, x, w []T) { MatMulParallel(xout, x, w) }
 
 func ArgMax[T float32 | float64](v []T) int {
@@ -105,7 +152,11 @@ func ArgMax[T float32 | float64](v []T) int {
 
 // Sample index from probabilities, they must sum to 1
 func Sample[T float32 | float64](probabilities []T) int {
-	r := T(rand.Float32())
+	return SampleWith(probabilities, T(rand.Float32()))
+}
+
+// SampleWith samples index from probabilities with uniform random number r in [0, 1)
+func SampleWith[T float32 | float64](probabilities []T, r T) int {
 	var cdf T
 	for i, p := range probabilities {
 		cdf += p
@@ -113,51 +164,315 @@ func Sample[T float32 | float64](probabilities []T) int {
 			return i
 		}
 	}
-	return len(probabilities) - 1
+	// in case of rounding errors, last possible index
+	for i := len(probabilities) - 1; i > 0; i-- {
+		if probabilities[i] > 0 {
+			return i
+		}
+	}
+	return 0
 }
 
 // SampleTopP ("top-p" sampling, or "nucleus sampling") samples from the smallest set of
 // tokens that exceed probability topp. This way we never sample tokens that
 // have very low probabilities and are less likely to go "off the rails".
-// Notes on llama2.c: here not reusing probability index slice, since practically it is as fast to request new one.
+// It allocates new buffer on each call, use Truncator to reuse it.
 func SampleTopP[T float32 | float64](probabilities []T, topp T) int {
-	type PI struct {
-		prob  T
-		index int
+	var t Truncator[T]
+	return t.SampleTopP(probabilities, topp)
+}
+
+// TopK keeps only probabilities of k most likely tokens and renormalizes them.
+// Tokens with the same probability as k-th most likely token are kept as well.
+// It allocates new buffer on each call, use Truncator to reuse it.
+func TopK[T float32 | float64](probabilities []T, k int) {
+	var t Truncator[T]
+	t.TopK(probabilities, k)
+}
+
+// MinP keeps only probabilities that are at least minp fraction of the most likely token and renormalizes them.
+func MinP[T float32 | float64](probabilities []T, minp T) {
+	if minp <= 0 {
+		return
+	}
+	threshold := probabilities[ArgMax(probabilities)] * minp
+	var sum T
+	for i, p := range probabilities {
+		if p < threshold {
+			probabilities[i] = 0
+		}
+		sum += probabilities[i]
+	}
+	for i := range probabilities {
+		probabilities[i] /= sum
 	}
-	pis := make([]PI, 0, len(probabilities))
+}
 
-	// quicksort indices in descending order of probabilities
-	// values smaller than (1 - topp) / (n - 1) cannot be part of the result
-	// so for efficiency we crop these out as candidates before sorting
-	cutoff := (1.0 - topp) / T(len(probabilities)-1)
+// partition reorders pis in descending order of probability around median of three as pivot,
+// which avoids quadratic time of quickselect on sorted input.
+// Result is [> pivot][== pivot][< pivot], where [lt, gt] is equal part and sum is of larger part.
+func partition[T float32 | float64](pis []probIndex[T]) (pivot T, lt, gt int, sum T) {
+	a, b, c := pis[0].prob, pis[len(pis)/2].prob, pis[len(pis)-1].prob
+	pivot = max(min(a, b), min(max(a, b), c))
+
+	lt, gt = 0, len(pis)-1
+	for i := 0; i <= gt; {
+		switch p := pis[i].prob; {
+		case p > pivot:
+			pis[lt], pis[i] = pis[i], pis[lt]
+			sum += p
+			lt++
+			i++
+		case p < pivot:
+			pis[gt], pis[i] = pis[i], pis[gt]
+			gt--
+		default:
+			i++
+		}
+	}
+	return pivot, lt, gt, sum
+}
+
+// kthLargest finds k-th (1-based) largest probability with quickselect, reordering pis in place.
+func kthLargest[T float32 | float64](pis []probIndex[T], k int) T {
+	lo, hi, target := 0, len(pis), k-1
+	for hi-lo > 1 {
+		pivot, lt, gt, _ := partition(pis[lo:hi])
+		switch {
+		case target < lo+lt:
+			hi = lo + lt
+		case target > lo+gt:
+			lo += gt + 1
+		default:
+			return pivot
+		}
+	}
+	return pis[target].prob
+}
+
+// Truncator removes unlikely tokens from probabilities.
+// It reuses one buffer of sorted probabilities across calls, so it should not be shared between goroutines.
+type Truncator[T float32 | float64] struct {
+	sorted []probIndex[T]
+}
+
+type probIndex[T float32 | float64] struct {
+	prob  T
+	key   T
+	index int
+}
+
+// sort non-zero probabilities in ascending order of key into buffer
+func (t *Truncator[T]) sort(probabilities []T, key func(p T) T) []probIndex[T] {
+	t.sorted = t.sorted[:0]
 	for i, p := range probabilities {
-		if p >= cutoff {
-			pis = append(pis, PI{prob: p, index: i})
+		if p > 0 {
+			t.sorted = append(t.sorted, probIndex[T]{prob: p, key: key(p), index: i})
+		}
+	}
+	slices.SortFunc(t.sorted, func(a, b probIndex[T]) int { return cmp.Compare(a.key, b.key) })
+	return t.sorted
+}
+
+// keep only probabilities of given tokens and renormalize them
+func keep[T float32 | float64](probabilities []T, kept []probIndex[T]) {
+	var sum T
+	for _, pi := range kept {
+		sum += pi.prob
+	}
+	clear(probabilities)
+	for _, pi := range kept {
+		probabilities[pi.index] = pi.prob / sum
+	}
+}
+
+func entropy[T float32 | float64](probabilities []T) (h T) {
+	for _, p := range probabilities {
+		if p > 0 {
+			h -= p * T(math.Log(float64(p)))
 		}
 	}
-	sort.Slice(pis, func(i, j int) bool { return pis[i].prob > pis[j].prob })
+	return h
+}
 
-	// truncate the list where cumulative probability exceeds topp
-	cumulativeProb := T(0)
-	lastIdx := len(pis) - 1 // in case of rounding errors consider all elements
-	for i, pi := range pis {
+// Typical keeps locally typical tokens, whose surprise is closest to entropy of distribution,
+// until their cumulative probability reaches mass.
+// https://arxiv.org/abs/2202.00666
+func (t *Truncator[T]) Typical(probabilities []T, mass T) {
+	if mass <= 0 || mass >= 1 {
+		return
+	}
+	h := entropy(probabilities)
+	sorted := t.sort(probabilities, func(p T) T { return T(math.Abs(-math.Log(float64(p)) - float64(h))) })
+
+	var cumulativeProb T
+	last := len(sorted) - 1
+	for i, pi := range sorted {
 		cumulativeProb += pi.prob
-		if cumulativeProb > topp {
-			lastIdx = i
-			break // we've exceeded topp by including lastIdx
+		if cumulativeProb >= mass {
+			last = i
+			break
 		}
 	}
+	keep(probabilities, sorted[:last+1])
+}
+
+// TailFree cuts off tail of distribution where second derivative of sorted probabilities flattens out,
+// that is it keeps i most likely tokens, where i is the first index at which cumulative normalized
+// absolute second derivative exceeds z, same as llama.cpp. At least one token is kept.
+// https://www.trentonbricken.com/Tail-Free-Sampling/
+func (t *Truncator[T]) TailFree(probabilities []T, z T) {
+	if z <= 0 || z >= 1 {
+		return
+	}
+	sorted := t.sort(probabilities, func(p T) T { return -p })
+	if len(sorted) <= 2 {
+		return
+	}
+
+	// absolute second derivatives, stored in keys
+	var sum T
+	for i := 0; i < len(sorted)-2; i++ {
+		d := T(math.Abs(float64(sorted[i].prob - 2*sorted[i+1].prob + sorted[i+2].prob)))
+		sorted[i].key = d
+		sum += d
+	}
+	if sum == 0 {
+		return
+	}
+
+	var cumulative T
+	kept := len(sorted)
+	for i := 0; i < len(sorted)-2; i++ {
+		cumulative += sorted[i].key / sum
+		if cumulative > z && i >= 1 {
+			kept = i
+			break
+		}
+	}
+	keep(probabilities, sorted[:kept])
+}
+
+// Eta keeps tokens with probability above min(eta, sqrt(eta) * exp(-entropy)).
+// Most likely token is always kept.
+// https://arxiv.org/abs/2210.15191
+func (t *Truncator[T]) Eta(probabilities []T, eta T) {
+	if eta <= 0 {
+		return
+	}
+	h := entropy(probabilities)
+	epsilon := min(eta, T(math.Sqrt(float64(eta))*math.Exp(-float64(h))))
+
+	maxi := ArgMax(probabilities)
+	t.sorted = append(t.sorted[:0], probIndex[T]{prob: probabilities[maxi], index: maxi})
+	for i, p := range probabilities {
+		if p > epsilon && i != maxi {
+			t.sorted = append(t.sorted, probIndex[T]{prob: p, index: i})
+		}
+	}
+	keep(probabilities, t.sorted)
+}
+
+// TopK keeps only probabilities of k most likely tokens and renormalizes them.
+// Tokens with the same probability as k-th most likely token are kept as well.
+// Threshold is found by quickselect, which is linear on average.
+func (t *Truncator[T]) TopK(probabilities []T, k int) {
+	if k <= 0 || k >= len(probabilities) {
+		return
+	}
+	t.sorted = t.sorted[:0]
+	for _, p := range probabilities {
+		t.sorted = append(t.sorted, probIndex[T]{prob: p})
+	}
+	threshold := kthLargest(t.sorted, k)
+	var sum T
+	for i, p := range probabilities {
+		if p < threshold {
+			probabilities[i] = 0
+		}
+		sum += probabilities[i]
+	}
+	for i := range probabilities {
+		probabilities[i] /= sum
+	}
+}
+
+// TopP keeps the smallest set of most likely tokens with cumulative probability exceeding topp.
+func (t *Truncator[T]) TopP(probabilities []T, topp T) {
+	if topp <= 0 || topp >= 1 {
+		return
+	}
+	keep(probabilities, t.nucleus(probabilities, topp))
+}
+
+// SampleTopP samples index from the smallest set of most likely tokens with cumulative probability exceeding topp.
+func (t *Truncator[T]) SampleTopP(probabilities []T, topp T) int {
+	nucleus := t.nucleus(probabilities, topp)
+
+	var cumulativeProb T
+	for _, pi := range nucleus {
+		cumulativeProb += pi.prob
+	}
 
 	// sample from the truncated list
 	r := T(rand.Float32()) * cumulativeProb
 	cdf := T(0)
-	for i := 0; i <= lastIdx; i++ {
-		cdf += pis[i].prob
+	for _, pi := range nucleus {
+		cdf += pi.prob
 		if r < cdf {
-			return pis[i].index
+			return pi.index
+		}
+	}
+
+	return nucleus[len(nucleus)-1].index // in case of rounding errors
+}
+
+// nucleus finds the smallest set of most likely tokens with cumulative probability exceeding topp, in no particular order.
+// It is quickselect that accumulates probabilities of partitions of larger values, so it is linear on average.
+func (t *Truncator[T]) nucleus(probabilities []T, topp T) []probIndex[T] {
+	// values smaller than (1 - topp) / (n - 1) cannot be part of the result
+	// so for efficiency we crop these out as candidates before selection
+	cutoff := (1.0 - topp) / T(len(probabilities)-1)
+	var sum T
+	t.sorted = t.sorted[:0]
+	for i, p := range probabilities {
+		if p >= cutoff && p > 0 {
+			t.sorted = append(t.sorted, probIndex[T]{prob: p, index: i})
+			sum += p
+		}
+	}
+	if sum <= topp {
+		// cutoff is too high for few tokens, consider all of them
+		t.sorted = t.sorted[:0]
+		for i, p := range probabilities {
+			if p > 0 {
+				t.sorted = append(t.sorted, probIndex[T]{prob: p, index: i})
+			}
+		}
+	}
+	pis := t.sorted
+
+	var cumulativeProb T
+	lo, hi := 0, len(pis)
+	for lo < hi {
+		_, lt, gt, sum := partition(pis[lo:hi])
+		lt, gt = lo+lt, lo+gt
+
+		if cumulativeProb+sum > topp {
+			// result is within larger values
+			hi = lt
+			continue
+		}
+		cumulativeProb += sum
+		for i := lt; i <= gt; i++ {
+			cumulativeProb += pis[i].prob
+			if cumulativeProb > topp {
+				return pis[:i+1]
+			}
 		}
+		lo = gt + 1
 	}
 
-	return pis[lastIdx].index // in case of rounding errors
+	// in case of rounding errors consider all elements
+	return pis
 }
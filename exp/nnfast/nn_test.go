@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
 	"slices"
+	"sync"
 	"testing"
 
 	"github.com/nikolaydubina/llama2.go/exp/nnfast"
@@ -81,47 +83,49 @@ func TestArgMax(t *testing.T) {
 
 func TestMatMul(t *testing.T) {
 	tests := []struct {
-		x          []float32
-		w          []float32
-		exp        []float32
-		numThreads int
+		x        []float32
+		w        []float32
+		exp      []float32
+		poolSize int
 	}{
 		{
-			x:          []float32{1, 2, 3, 4, 5},
-			w:          []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
-			exp:        []float32{1 + 4 + 9 + 16 + 25, 6 + 14 + 24 + 36 + 50},
-			numThreads: 8,
+			x:        []float32{1, 2, 3, 4, 5},
+			w:        []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			exp:      []float32{1 + 4 + 9 + 16 + 25, 6 + 14 + 24 + 36 + 50},
+			poolSize: 8,
 		},
 		{
-			x:          []float32{1, 2, 3},
-			w:          []float32{1, 2, 3, 4, 5, 6},
-			exp:        []float32{1 + 4 + 9, 4 + 10 + 18},
-			numThreads: 8,
+			x:        []float32{1, 2, 3},
+			w:        []float32{1, 2, 3, 4, 5, 6},
+			exp:      []float32{1 + 4 + 9, 4 + 10 + 18},
+			poolSize: 8,
 		},
 		{
-			x:          []float32{1, 2, 3},
-			w:          []float32{1, 2, 3, 4, 5, 6},
-			exp:        []float32{1 + 4 + 9, 4 + 10 + 18},
-			numThreads: 2,
+			x:        []float32{1, 2, 3},
+			w:        []float32{1, 2, 3, 4, 5, 6},
+			exp:      []float32{1 + 4 + 9, 4 + 10 + 18},
+			poolSize: 2,
 		},
 		{
-			x:          []float32{1, 2, 3},
-			w:          []float32{1, 2, 3, 4, 5, 6, 7, 8, 9},
-			exp:        []float32{1 + 4 + 9, 4 + 10 + 18, 7 + 16 + 27},
-			numThreads: 2,
+			x:        []float32{1, 2, 3},
+			w:        []float32{1, 2, 3, 4, 5, 6, 7, 8, 9},
+			exp:      []float32{1 + 4 + 9, 4 + 10 + 18, 7 + 16 + 27},
+			poolSize: 2,
 		},
 		{
-			x:          []float32{1, 2, 3},
-			w:          []float32{1, 2, 3, 4, 5, 6, 7, 8, 9},
-			exp:        []float32{1 + 4 + 9, 4 + 10 + 18, 7 + 16 + 27},
-			numThreads: 3,
+			x:        []float32{1, 2, 3},
+			w:        []float32{1, 2, 3, 4, 5, 6, 7, 8, 9},
+			exp:      []float32{1 + 4 + 9, 4 + 10 + 18, 7 + 16 + 27},
+			poolSize: 3,
 		},
 	}
 	for i, tc := range tests {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			pool := nnfast.NewPool(tc.poolSize)
+			defer pool.Close()
+
 			got := make([]float32, len(tc.exp))
-			nnfast.NumThreads = tc.numThreads
-			nnfast.MatMul(got, tc.x, tc.w)
+			nnfast.MatMulPool(pool, got, tc.x, tc.w)
 			if !slices.Equal(tc.exp, got) {
 				t.Errorf("got %v, exp %v", got, tc.exp)
 			}
@@ -129,6 +133,44 @@ func TestMatMul(t *testing.T) {
 	}
 }
 
+// matMulGoroutines starts goroutine for each chunk of rows, as was done before pool.
+func matMulGoroutines(xout, x, w []float32, numThreads int) {
+	n, m := len(xout), len(x)
+	var wg sync.WaitGroup
+	wg.Add(numThreads)
+	for i := 0; i < numThreads; i++ {
+		rowStart, rowEnd := i*n/numThreads, (i+1)*n/numThreads
+		go func() { nnfast.MatMulUnroll4(xout[rowStart:rowEnd], x, w[m*rowStart:m*rowEnd]); wg.Done() }()
+	}
+	wg.Wait()
+}
+
+// BenchmarkMatMulScheduling compares pool to goroutines for each call.
+// Pool does not allocate and is faster on small matrices, where scheduling dominates;
+// on larger ones work dominates and they are about the same.
+func BenchmarkMatMulScheduling(b *testing.B) {
+	threads := runtime.GOMAXPROCS(0)
+	for _, d := range []int{64, 288} {
+		x, w, xout := make([]float32, d), make([]float32, d*d), make([]float32, d)
+
+		b.Run(fmt.Sprintf("d_%d/goroutines", d), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matMulGoroutines(xout, x, w, threads)
+			}
+		})
+
+		b.Run(fmt.Sprintf("d_%d/pool", d), func(b *testing.B) {
+			pool := nnfast.NewPool(threads)
+			defer pool.Close()
+			var task nnfast.MatMulTask[float32]
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				task.MatMul(pool, x, xout, w)
+			}
+		})
+	}
+}
+
 func fillRand(x []float32, rnd *rand.Rand) {
 	for i := range x {
 		x[i] = rnd.Float32()
@@ -160,6 +202,35 @@ func FuzzMatMul(f *testing.F) {
 	})
 }
 
+func FuzzMatMulBatch(f *testing.F) {
+	f.Add(uint(7), uint(9), uint(5), uint(1))
+	f.Add(uint(16), uint(8), uint(4), uint(2))
+	f.Fuzz(func(t *testing.T, n, m, batch, seed uint) {
+		if n == 0 || m == 0 || batch == 0 || batch*n*m > 10000 {
+			t.Skip()
+		}
+
+		x := make([]float32, batch*n)
+		w := make([]float32, n*m)
+
+		rnd := rand.New(rand.NewSource(int64(seed)))
+		fillRand(x, rnd)
+		fillRand(w, rnd)
+
+		o := make([]float32, batch*m)
+		nnfast.MatMulBatch(o, x, w, int(batch))
+
+		o1 := make([]float32, batch*m)
+		for b := uint(0); b < batch; b++ {
+			nn.MatMul(o1[b*m:(b+1)*m], x[b*n:(b+1)*n], w)
+		}
+
+		if !slices.Equal(o1, o) {
+			t.Errorf("got %v, exp %v", o, o1)
+		}
+	})
+}
+
 func FuzzSampleTopP(f *testing.F) {
 	tests := []struct {
 		probabilities []float32
@@ -203,3 +274,226 @@ func FuzzSampleTopP(f *testing.F) {
 		}
 	})
 }
+
+func randProbabilities(n int, rnd *rand.Rand) []float32 {
+	x := make([]float32, n)
+	for i := range x {
+		// coarse values to have ties
+		x[i] = float32(rnd.Intn(10))
+	}
+	x[rnd.Intn(n)] = 10
+	nn.SoftMax(x)
+	return x
+}
+
+func FuzzTopK(f *testing.F) {
+	f.Add(uint(5), uint(2), int64(1))
+	f.Add(uint(100), uint(10), int64(7))
+	f.Add(uint(1000), uint(1), int64(42))
+	f.Fuzz(func(t *testing.T, n, k uint, seed int64) {
+		if n == 0 || n > 10000 {
+			t.Skip()
+		}
+		rnd := rand.New(rand.NewSource(seed))
+
+		x := randProbabilities(int(n), rnd)
+		x1 := slices.Clone(x)
+
+		nnfast.TopK(x, int(k))
+		nn.TopK(x1, int(k))
+
+		if !slices.Equal(x1, x) {
+			t.Errorf("got %v, exp %v", x, x1)
+		}
+	})
+}
+
+func FuzzMinP(f *testing.F) {
+	f.Add(uint(5), float32(0.1), int64(1))
+	f.Add(uint(100), float32(0.05), int64(7))
+	f.Add(uint(1000), float32(0.9), int64(42))
+	f.Fuzz(func(t *testing.T, n uint, minp float32, seed int64) {
+		if n == 0 || n > 10000 || minp > 1 || math.IsNaN(float64(minp)) {
+			t.Skip()
+		}
+		rnd := rand.New(rand.NewSource(seed))
+
+		x := randProbabilities(int(n), rnd)
+		x1 := slices.Clone(x)
+
+		nnfast.MinP(x, minp)
+		nn.MinP(x1, minp)
+
+		if !slices.Equal(x1, x) {
+			t.Errorf("got %v, exp %v", x, x1)
+		}
+	})
+}
+
+// randSparseProbabilities has some of probabilities set to zero
+func randSparseProbabilities(n int, rnd *rand.Rand) []float32 {
+	x := make([]float32, n)
+	var sum float32
+	for i := range x {
+		if rnd.Intn(3) > 0 {
+			x[i] = rnd.Float32() * rnd.Float32()
+		}
+		sum += x[i]
+	}
+	if sum == 0 {
+		x[rnd.Intn(n)], sum = 1, 1
+	}
+	for i := range x {
+		x[i] /= sum
+	}
+	return x
+}
+
+func fuzzTruncator(f *testing.F, truncate func(t *nnfast.Truncator[float32], probabilities []float32, param float32)) {
+	f.Add(uint(5), float32(0.5), int64(1))
+	f.Add(uint(100), float32(0.95), int64(7))
+	f.Add(uint(1000), float32(0.001), int64(42))
+	f.Add(uint(3), float32(0.2), int64(3))
+	var truncator nnfast.Truncator[float32]
+	f.Fuzz(func(t *testing.T, n uint, param float32, seed int64) {
+		if n == 0 || n > 10000 || math.IsNaN(float64(param)) {
+			t.Skip()
+		}
+		rnd := rand.New(rand.NewSource(seed))
+
+		x := randSparseProbabilities(int(n), rnd)
+		x0 := slices.Clone(x)
+
+		truncate(&truncator, x, param)
+
+		for i := 0; i < 10; i++ {
+			if v := nnfast.Sample(x); x0[v] == 0 || x[v] == 0 {
+				t.Errorf("index %d has zero probability, original %v, truncated %v", v, x0[v], x[v])
+			}
+		}
+	})
+}
+
+func FuzzTruncatorTypical(f *testing.F) {
+	fuzzTruncator(f, func(t *nnfast.Truncator[float32], probabilities []float32, param float32) {
+		t.Typical(probabilities, param)
+	})
+}
+
+func FuzzTruncatorTailFree(f *testing.F) {
+	fuzzTruncator(f, func(t *nnfast.Truncator[float32], probabilities []float32, param float32) {
+		t.TailFree(probabilities, param)
+	})
+}
+
+func FuzzTailFree(f *testing.F) {
+	f.Add(uint(5), float32(0.5), int64(1))
+	f.Add(uint(100), float32(0.95), int64(7))
+	f.Add(uint(3), float32(0.2), int64(3))
+	var truncator nnfast.Truncator[float32]
+	f.Fuzz(func(t *testing.T, n uint, z float32, seed int64) {
+		if n == 0 || n > 10000 || math.IsNaN(float64(z)) {
+			t.Skip()
+		}
+		rnd := rand.New(rand.NewSource(seed))
+
+		x := randSparseProbabilities(int(n), rnd)
+		x1 := slices.Clone(x)
+
+		truncator.TailFree(x, z)
+		nn.TailFree(x1, z)
+
+		count := func(x []float32) (n int) {
+			for _, p := range x {
+				if p > 0 {
+					n++
+				}
+			}
+			return n
+		}
+		if count(x) != count(x1) {
+			t.Errorf("kept %d, exp %d", count(x), count(x1))
+		}
+	})
+}
+
+func FuzzTruncatorEta(f *testing.F) {
+	fuzzTruncator(f, func(t *nnfast.Truncator[float32], probabilities []float32, param float32) {
+		t.Eta(probabilities, param)
+	})
+}
+
+func FuzzTruncatorTopP(f *testing.F) {
+	fuzzTruncator(f, func(t *nnfast.Truncator[float32], probabilities []float32, param float32) {
+		t.TopP(probabilities, param)
+	})
+}
+
+func FuzzMatMulTask(f *testing.F) {
+	f.Add(uint(3), uint(5), uint(2), uint(4), uint(1))
+	f.Add(uint(16), uint(16), uint(8), uint(3), uint(7))
+	f.Add(uint(1), uint(1), uint(1), uint(1), uint(0))
+	f.Fuzz(func(t *testing.T, n, m1, m2, poolSize, seed uint) {
+		if n == 0 || m1 == 0 || m2 == 0 || n*(m1+m2) > 10000 || poolSize == 0 || poolSize > 16 {
+			t.Skip()
+		}
+		rnd := rand.New(rand.NewSource(int64(seed)))
+
+		x := make([]float32, n)
+		w1 := make([]float32, n*m1)
+		w2 := make([]float32, n*m2)
+		fillRand(x, rnd)
+		fillRand(w1, rnd)
+		fillRand(w2, rnd)
+
+		pool := nnfast.NewPool(int(poolSize))
+		defer pool.Close()
+
+		var task nnfast.MatMulTask[float32]
+		o1, o2 := make([]float32, m1), make([]float32, m2)
+		task.MatMul(pool, x, o1, w1, o2, w2)
+
+		e1, e2 := make([]float32, m1), make([]float32, m2)
+		nn.MatMul(e1, x, w1)
+		nn.MatMul(e2, x, w2)
+
+		if !slices.Equal(e1, o1) || !slices.Equal(e2, o2) {
+			t.Errorf("got %v %v, exp %v %v", o1, o2, e1, e2)
+		}
+	})
+}
+
+func FuzzMatMulTaskBatch(f *testing.F) {
+	f.Add(uint(3), uint(5), uint(40), uint(4), uint(4), uint(1))
+	f.Add(uint(16), uint(17), uint(8), uint(3), uint(1), uint(7))
+	f.Add(uint(1), uint(1), uint(1), uint(1), uint(2), uint(0))
+	f.Fuzz(func(t *testing.T, n, m1, m2, poolSize, batch, seed uint) {
+		if n == 0 || m1 == 0 || m2 == 0 || batch == 0 || batch*n*(m1+m2) > 10000 || poolSize == 0 || poolSize > 16 {
+			t.Skip()
+		}
+		rnd := rand.New(rand.NewSource(int64(seed)))
+
+		x := make([]float32, batch*n)
+		w1 := make([]float32, n*m1)
+		w2 := make([]float32, n*m2)
+		fillRand(x, rnd)
+		fillRand(w1, rnd)
+		fillRand(w2, rnd)
+
+		pool := nnfast.NewPool(int(poolSize))
+		defer pool.Close()
+
+		var task nnfast.MatMulTask[float32]
+		o1, o2 := make([]float32, batch*m1), make([]float32, batch*m2)
+		task.MatMulBatch(pool, int(batch), x, o1, w1, o2, w2)
+
+		e1, e2 := make([]float32, batch*m1), make([]float32, batch*m2)
+		for b := uint(0); b < batch; b++ {
+			task.MatMul(pool, x[b*n:(b+1)*n], e1[b*m1:(b+1)*m1], w1, e2[b*m2:(b+1)*m2], w2)
+		}
+
+		if !slices.Equal(e1, o1) || !slices.Equal(e2, o2) {
+			t.Errorf("got %v %v, exp %v %v", o1, o2, e1, e2)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package nnfast
+
+import (
+	"sync/atomic"
+)
+
+// Task is parallel work split into chunks.
+// It should be pointer to reusable struct, so that passing it to Pool does not allocate.
+type Task interface {
+	Run(chunk int)
+}
+
+// Pool of long-lived worker goroutines.
+// Unlike starting goroutines for each parallel step, it does not allocate.
+// Run can be called by many goroutines at once, their tasks share workers.
+// Tasks running on pool should not run other tasks on the same pool, since it may deadlock.
+type Pool struct {
+	jobs  chan job
+	calls chan *call // free list of calls
+	size  int
+}
+
+type job struct {
+	task  Task
+	chunk int
+	call  *call
+}
+
+type call struct {
+	pending atomic.Int32
+	done    chan struct{}
+}
+
+// NewPool starts workers, together with caller of Run size goroutines run tasks in parallel.
+func NewPool(size int) *Pool {
+	size = max(size, 1)
+	p := &Pool{
+		jobs:  make(chan job, 4*size),
+		calls: make(chan *call, 64),
+		size:  size,
+	}
+	for i := 1; i < p.size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *Pool) work() {
+	for j := range p.jobs {
+		j.task.Run(j.chunk)
+		if j.call.pending.Add(-1) == 0 {
+			j.call.done <- struct{}{}
+		}
+	}
+}
+
+// Size is number of goroutines that run tasks in parallel, including caller of Run.
+func (p *Pool) Size() int { return p.size }
+
+// Run chunks [0, n) of task on workers and waits for all of them to finish.
+// Chunk 0 is run by caller.
+func (p *Pool) Run(task Task, n int) {
+	if n <= 1 || p.size == 1 {
+		for i := 0; i < n; i++ {
+			task.Run(i)
+		}
+		return
+	}
+
+	var c *call
+	select {
+	case c = <-p.calls:
+	default:
+		c = &call{done: make(chan struct{}, 1)}
+	}
+
+	c.pending.Store(int32(n - 1))
+	for i := 1; i < n; i++ {
+		p.jobs <- job{task: task, chunk: i, call: c}
+	}
+	task.Run(0)
+	<-c.done
+
+	select {
+	case p.calls <- c:
+	default:
+	}
+}
+
+// Close stops workers once queued tasks are done.
+func (p *Pool) Close() { close(p.jobs) }
+
+// MatMulTask is parallel W (d,n) @ x (n,) -> xout (d,) of several matrices that share x.
+// Rows of all matrices are split evenly into chunks.
+// It is reused between calls, so it should not be shared between goroutines.
+type MatMulTask[T float32 | float64] struct {
+	x      []T
+	outs   [][]T
+	ws     [][]T
+	batch  int
+	rows   int
+	chunks int
+}
+
+// MatMul computes pairs of xout and w for same x on pool.
+func (t *MatMulTask[T]) MatMul(pool *Pool, x []T, xoutw ...[]T) { t.MatMulBatch(pool, 1, x, xoutw...) }
+
+// MatMulBatch computes pairs of xout (batch,d) and w (d,n) for same x (batch,n) on pool.
+// Rows of W are multiplied by several vectors at once with MatMulBatch, results are same as of MatMul for each vector.
+func (t *MatMulTask[T]) MatMulBatch(pool *Pool, batch int, x []T, xoutw ...[]T) {
+	t.x, t.outs, t.ws, t.batch, t.rows = x, t.outs[:0], t.ws[:0], batch, 0
+	for i := 0; i+1 < len(xoutw); i += 2 {
+		t.outs = append(t.outs, xoutw[i])
+		t.ws = append(t.ws, xoutw[i+1])
+		t.rows += len(xoutw[i]) / batch
+	}
+	t.chunks = min(pool.Size(), t.rows)
+	pool.Run(t, t.chunks)
+}
+
+func (t *MatMulTask[T]) Run(chunk int) {
+	rowStart := chunk * t.rows / t.chunks
+	rowEnd := (chunk + 1) * t.rows / t.chunks
+
+	// rows of matrices are numbered one after another
+	offset, m := 0, len(t.x)/t.batch
+	for i, xout := range t.outs {
+		d := len(xout) / t.batch
+		start, end := max(rowStart-offset, 0), min(rowEnd-offset, d)
+		offset += d
+		if start >= end {
+			continue
+		}
+		if t.batch == 1 {
+			MatMulUnroll4(xout[start:end], t.x, t.ws[i][m*start:m*end])
+			continue
+		}
+		matMulBatch(xout[start:], d, t.x, t.ws[i][m*start:m*end], t.batch, m, end-start)
+	}
+}
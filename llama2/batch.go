@@ -0,0 +1,197 @@
+package llama2
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
+)
+
+// BatchRunState holds activations of several consecutive positions that are forwarded in one pass.
+// KV cache is of RunState, so that batch can continue sequence decoded token by token and other way around.
+type BatchRunState struct {
+	X      []float32 // (batch, dim)
+	XB     []float32 // (batch, dim)
+	XB2    []float32 // (batch, dim)
+	HB     []float32 // (batch, hidden_dim)
+	HB2    []float32 // (batch, hidden_dim)
+	Q      []float32 // (batch, dim)
+	K      []float32 // (batch, kv_dim)
+	V      []float32 // (batch, kv_dim)
+	Att    []float32 // (batch, n_heads, seq_len)
+	Logits []float32 // (batch, vocab_size) output logits of each position
+
+	tasks *transformerTasks // nil in BatchRunState that is not made by NewBatchRunState
+
+}
+
+// NewBatchRunState allocates state for up to batch positions.
+func NewBatchRunState(config Config, batch int) BatchRunState {
+	return BatchRunState{
+		X:      make([]float32, batch*config.Dim),
+		XB:     make([]float32, batch*config.Dim),
+		XB2:    make([]float32, batch*config.Dim),
+		HB:     make([]float32, batch*config.HiddenDim),
+		HB2:    make([]float32, batch*config.HiddenDim),
+		Q:      make([]float32, batch*config.Dim),
+		K:      make([]float32, batch*config.KVDim()),
+		V:      make([]float32, batch*config.KVDim()),
+		Att:    make([]float32, batch*config.NumHeads*config.SeqLen),
+		Logits: make([]float32, batch*config.VocabSize),
+		tasks:  &transformerTasks{},
+	}
+}
+
+// TransformerBatch forwards tokens at positions pos, pos+1, ... in one pass, appending them to KV cache of s.
+// Each weight matrix is read once for all tokens, which is faster than forwarding them one by one.
+// Logits of token i are in row i of b.Logits, they are same as of Transformer.
+func TransformerBatch(tokens []int, pos int, config Config, s RunState, b BatchRunState, w TransformerWeights) {
+	transformerBatch(context.Background(), tokens, batchPositions{s: s, pos: pos}, config, b, w, b.Logits[:len(tokens)*config.VocabSize])
+}
+
+// prefillBatch is number of prompt tokens forwarded in one pass by Session and BeamSearch.
+const prefillBatch = 64
+
+// TransformerPrefill forwards prompt tokens at positions pos, pos+1, ... appending them to KV cache of s,
+// in passes of as many tokens as b has room for.
+// Only logits of the last token are computed, they are written to s.Logits, same as by Transformer of that token.
+// Other activations of s are not updated.
+// Once ctx is done, it stops before the next layer and returns error of ctx.
+func TransformerPrefill(ctx context.Context, tokens []int, pos int, config Config, s RunState, b BatchRunState, w TransformerWeights) error {
+	batch := len(b.X) / config.Dim
+	for i := 0; i < len(tokens); i += batch {
+		var logits []float32
+		if i+batch >= len(tokens) {
+			logits = s.Logits
+		}
+		if err := transformerBatch(ctx, tokens[i:min(i+batch, len(tokens))], batchPositions{s: s, pos: pos + i}, config, b, w, logits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransformerMulti forwards next token of each of independent sequences in one pass, e.g. to serve several users.
+// Sequence i is at positions[i] with KV cache in states[i], its token is appended to it and logits are written to states[i].Logits,
+// same as by Transformer. Each weight matrix is read once for all sequences, so b should have room for len(tokens) positions.
+// It panics when lengths of tokens, positions and states differ or b is too small.
+// The same RunState should not be in states twice: its Logits would hold logits of only the last of its tokens,
+// and tokens at the same position would overwrite KV cache of each other. Use TransformerBatch for tokens of one sequence.
+func TransformerMulti(tokens, positions []int, config Config, states []RunState, b BatchRunState, w TransformerWeights) {
+	vocabSize := config.VocabSize
+	if len(positions) != len(tokens) || len(states) != len(tokens) {
+		panic(fmt.Sprintf("llama2: TransformerMulti got %d tokens, %d positions and %d states", len(tokens), len(positions), len(states)))
+	}
+	if capacity := len(b.Logits) / vocabSize; len(tokens) > capacity {
+		panic(fmt.Sprintf("llama2: TransformerMulti got %d tokens, batch run state has room for %d", len(tokens), capacity))
+	}
+	transformerBatch(context.Background(), tokens, batchPositions{states: states, positions: positions}, config, b, w, b.Logits[:len(tokens)*vocabSize])
+	for i, s := range states {
+		copy(s.Logits, b.Logits[i*vocabSize:(i+1)*vocabSize])
+	}
+}
+
+// batchPositions tells where rows of batch go: consecutive positions of one sequence or positions of several sequences.
+type batchPositions struct {
+	s   RunState // row i is at pos+i of s
+	pos int
+
+	states    []RunState // row i is at positions[i] of states[i], when set
+	positions []int
+}
+
+func (p batchPositions) at(i int) (RunState, int) {
+	if p.states != nil {
+		return p.states[i], p.positions[i]
+	}
+	return p.s, p.pos + i
+}
+
+// transformerBatch writes logits of the last len(logits)/vocab_size tokens to logits, rows of other tokens are not computed.
+func transformerBatch(ctx context.Context, tokens []int, seq batchPositions, config Config, b BatchRunState, w TransformerWeights, logits []float32) error {
+	n := len(tokens)
+	dim := config.Dim
+	kvDim := config.KVDim()
+	hiddenDim := config.HiddenDim
+	tasks := b.tasks.orNew()
+	matmul := &tasks.matmul
+	pool := w.pool()
+
+	x := b.X[:n*dim]
+	xb, xb2 := b.XB[:n*dim], b.XB2[:n*dim]
+	hb, hb2 := b.HB[:n*hiddenDim], b.HB2[:n*hiddenDim]
+	q, k, v := b.Q[:n*dim], b.K[:n*kvDim], b.V[:n*kvDim]
+
+	for i, token := range tokens {
+		copy(x[i*dim:(i+1)*dim], w.TokenEmbeddingTable[token*dim:(token+1)*dim])
+	}
+
+	// forward all layers
+	for l := 0; l < config.NumLayers; l++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			nn.RMSNorm(xb[i*dim:(i+1)*dim], x[i*dim:(i+1)*dim], w.RMSAttentionWeight[l*dim:((l+1)*dim)])
+		}
+
+		// Q,K,V matmuls for all positions
+		matmul.MatMulBatch(pool, n, xb,
+			q, w.WQ[l*dim*dim:(l+1)*dim*dim],
+			k, w.WK[l*dim*kvDim:(l+1)*dim*kvDim],
+			v, w.WV[l*dim*kvDim:(l+1)*dim*kvDim],
+		)
+
+		// RoPE and saving key and val of each position to cache, before attention looks at them
+		loff := l * config.SeqLen * kvDim
+		for i := 0; i < n; i++ {
+			s, pos := seq.at(i)
+			rope(q[i*dim:(i+1)*dim], k[i*kvDim:(i+1)*kvDim], pos, config)
+			copy(s.KCache[(loff+pos*kvDim):(loff+(pos+1)*kvDim)], k[i*kvDim:(i+1)*kvDim])
+			copy(s.VCache[(loff+pos*kvDim):(loff+(pos+1)*kvDim)], v[i*kvDim:(i+1)*kvDim])
+		}
+
+		// multihead attention of all heads of all positions
+		tasks.attention = attentionTask{q: q, att: b.Att, xb: xb, seq: seq, config: config, loff: loff}
+		pool.Run(&tasks.attention, n*config.NumHeads)
+
+		// final matmul to get the output of the attention
+		matmul.MatMulBatch(pool, n, xb, xb2, w.WO[l*dim*dim:(l+1)*dim*dim])
+
+		// residual connection back into x
+		nn.Acc(x, xb2)
+
+		// FFN RMSNorm
+		for i := 0; i < n; i++ {
+			nn.RMSNorm(xb[i*dim:(i+1)*dim], x[i*dim:(i+1)*dim], w.RMSFFNWeight[l*dim:(l+1)*dim])
+		}
+
+		// self.w2(F.silu(self.w1(x)) * self.w3(x))
+		matmul.MatMulBatch(pool, n, xb,
+			hb, w.W1[l*dim*hiddenDim:(l+1)*dim*hiddenDim],
+			hb2, w.W3[l*dim*hiddenDim:(l+1)*dim*hiddenDim],
+		)
+		for i := range hb {
+			hb[i] /= (1.0 + float32(math.Exp(-float64(hb[i]))))
+			hb[i] *= hb2[i]
+		}
+		matmul.MatMulBatch(pool, n, hb, xb, w.W2[l*dim*hiddenDim:(l+1)*dim*hiddenDim])
+
+		// residual connection
+		nn.Acc(x, xb)
+	}
+
+	// final RMSNorm of positions that logits are needed for
+	rows := len(logits) / config.VocabSize
+	for i := n - rows; i < n; i++ {
+		nn.RMSNorm(x[i*dim:(i+1)*dim], x[i*dim:(i+1)*dim], w.RMSFinalWeight)
+	}
+
+	// classifier into logits
+	if rows > 0 {
+		matmul.MatMulBatch(pool, rows, x[(n-rows)*dim:], logits, w.WCLS)
+	}
+	return nil
+}
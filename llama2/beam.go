@@ -0,0 +1,163 @@
+package llama2
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+)
+
+type BeamSearchOptions struct {
+	Width         int     // number of beams kept at each step
+	LengthPenalty float32 // score is sum of log-probabilities divided by length^LengthPenalty (0 = no penalty)
+	EarlyStopping bool    // stop as soon as Width hypotheses are finished, otherwise when no beam can improve them
+	MaxTokens     int     // maximum number of generated tokens
+	NumResults    int     // number of best hypotheses to return (0 = Width)
+
+	// Processors are applied to logits of each beam before log-probabilities, with prompt and tokens of beam as history (optional).
+	// Beams do not share history, so processors should not keep state between calls, e.g. LogitBias and Penalties.
+	Processors LogitsProcessor
+}
+
+// Hypothesis is one of beam search results.
+type Hypothesis struct {
+	Tokens   []int   // generated tokens, without prompt
+	LogProb  float32 // sum of log-probabilities of generated tokens
+	Score    float32 // length penalized log-probability
+	Finished bool    // ended with BOS (1) token, which is not included into Tokens
+}
+
+type beam struct {
+	tokens  []int
+	logProb float32
+	state   int // index of RunState
+}
+
+type beamCandidate struct {
+	parent  int
+	token   int
+	logProb float32
+}
+
+// BeamSearch decodes the most likely continuations of prompt, keeping Width best partial sequences at each step.
+// Each beam has own RunState, and KV cache of parent beam is copied into it when beam is forked.
+// It returns ErrContextFull when prompt does not fit into context.
+func BeamSearch(config Config, w TransformerWeights, prompt []int, opts BeamSearchOptions) ([]Hypothesis, error) {
+	if opts.Width <= 0 {
+		opts.Width = 1
+	}
+	if opts.NumResults <= 0 || opts.NumResults > opts.Width {
+		opts.NumResults = opts.Width
+	}
+	if len(prompt)+1 > config.SeqLen {
+		return nil, ErrContextFull
+	}
+
+	// states of current beams and spare ones for beams of the next step
+	states := make([]RunState, 2*opts.Width)
+	for i := range states {
+		states[i] = NewRunState(config)
+	}
+	spare := make([]int, 0, len(states))
+	for i := opts.Width; i < len(states); i++ {
+		spare = append(spare, i)
+	}
+
+	// feed BOS (1) token and prompt into the first beam
+	beams := []beam{{state: 0}}
+	tokens := append([]int{1}, prompt...)
+	TransformerPrefill(context.Background(), tokens, 0, config, states[0], NewBatchRunState(config, min(prefillBatch, len(tokens))), w)
+	pos := len(tokens)
+
+	score := func(logProb float32, length int) float32 {
+		return logProb / float32(math.Pow(float64(length), float64(opts.LengthPenalty)))
+	}
+
+	var finished []Hypothesis
+	var candidates []beamCandidate
+	logits := make([]float32, config.VocabSize)
+	history := append(make([]int, 0, config.SeqLen), prompt...)
+	for step := 0; len(beams) > 0 && step < opts.MaxTokens && pos < config.SeqLen; step++ {
+		// each beam can contribute at most Width best next tokens
+		candidates = candidates[:0]
+		for i, b := range beams {
+			copy(logits, states[b.state].Logits)
+			if opts.Processors != nil {
+				opts.Processors.Process(append(history[:len(prompt)], b.tokens...), logits)
+			}
+			for _, t := range NewLogProbs(logits, 0, opts.Width).Top {
+				if math.IsInf(float64(t.LogProb), -1) {
+					// banned by processors
+					continue
+				}
+				candidates = append(candidates, beamCandidate{parent: i, token: t.Token, logProb: b.logProb + t.LogProb})
+			}
+		}
+		slices.SortStableFunc(candidates, func(a, b beamCandidate) int { return cmp.Compare(b.logProb, a.logProb) })
+
+		var next []beam
+		for rank, c := range candidates {
+			if len(next) == opts.Width {
+				break
+			}
+			parent := beams[c.parent]
+			if c.token == 1 {
+				// data-dependent terminating condition: the BOS (1) token delimits sequences
+				if rank < opts.Width {
+					finished = append(finished, Hypothesis{
+						Tokens:   slices.Clone(parent.tokens),
+						LogProb:  c.logProb,
+						Score:    score(c.logProb, len(parent.tokens)+1),
+						Finished: true,
+					})
+				}
+				continue
+			}
+
+			state := spare[len(next)]
+			states[parent.state].CopyKVCache(states[state], pos, config)
+			Transformer(c.token, pos, config, states[state], w)
+
+			next = append(next, beam{
+				tokens:  append(slices.Clone(parent.tokens), c.token),
+				logProb: c.logProb,
+				state:   state,
+			})
+		}
+		pos++
+
+		// states of previous beams are spare for the next step
+		spare = spare[:0]
+		for i := range states {
+			if !slices.ContainsFunc(next, func(b beam) bool { return b.state == i }) {
+				spare = append(spare, i)
+			}
+		}
+		beams = next
+
+		if len(finished) >= opts.Width {
+			if opts.EarlyStopping || len(beams) == 0 {
+				break
+			}
+			// best beam is not expected to do better than worst finished hypothesis, since log-probabilities only decrease
+			worst := finished[0].Score
+			for _, h := range finished {
+				worst = min(worst, h.Score)
+			}
+			if score(beams[0].logProb, len(beams[0].tokens)) < worst {
+				break
+			}
+		}
+	}
+
+	for _, b := range beams {
+		finished = append(finished, Hypothesis{
+			Tokens:  b.tokens,
+			LogProb: b.logProb,
+			Score:   score(b.logProb, len(b.tokens)),
+		})
+	}
+	slices.SortStableFunc(finished, func(a, b Hypothesis) int { return cmp.Compare(b.Score, a.Score) })
+
+	return finished[:min(len(finished), opts.NumResults)], nil
+}
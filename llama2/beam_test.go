@@ -0,0 +1,107 @@
+package llama2_test
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestBeamSearchGreedy(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	prompt := []int{5, 17, 3}
+	expected := greedyDecode(testConfig, w, prompt, 20)
+
+	hypotheses, err := llama2.BeamSearch(testConfig, w, prompt, llama2.BeamSearchOptions{Width: 1, MaxTokens: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hypotheses) != 1 || !slices.Equal(expected, hypotheses[0].Tokens) {
+		t.Errorf("got %v, exp %v", hypotheses, expected)
+	}
+}
+
+func TestBeamSearchScore(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	for _, lengthPenalty := range []float32{0, 1, 2} {
+		hypotheses, err := llama2.BeamSearch(testConfig, w, []int{5, 17}, llama2.BeamSearchOptions{Width: 4, MaxTokens: 10, LengthPenalty: lengthPenalty})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hypotheses) != 4 {
+			t.Fatalf("got %d hypotheses", len(hypotheses))
+		}
+		for i, h := range hypotheses {
+			// BOS (1) token that finished hypothesis is counted in its length
+			length := len(h.Tokens)
+			if h.Finished {
+				length++
+			}
+			if score := h.LogProb / float32(math.Pow(float64(length), float64(lengthPenalty))); math.Abs(float64(score-h.Score)) > 1e-5 {
+				t.Errorf("length penalty %v: score %v, exp %v", lengthPenalty, h.Score, score)
+			}
+			if i > 0 && h.Score > hypotheses[i-1].Score {
+				t.Errorf("length penalty %v: hypothesis %d has score %v above previous %v", lengthPenalty, i, h.Score, hypotheses[i-1].Score)
+			}
+		}
+	}
+}
+
+// bosAfter makes BOS (1) token the most likely once history is of given length.
+type bosAfter struct {
+	length, maxLength int
+}
+
+func (p *bosAfter) Process(history []int, logits []float32) {
+	p.maxLength = max(p.maxLength, len(history))
+	if len(history) == p.length {
+		logits[1] = 100
+	}
+}
+
+func TestBeamSearchEarlyStopping(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	prompt := []int{5, 17}
+	bos := &bosAfter{length: len(prompt) + 3}
+
+	hypotheses, err := llama2.BeamSearch(testConfig, w, prompt, llama2.BeamSearchOptions{Width: 3, MaxTokens: 20, EarlyStopping: true, Processors: bos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all beams are finished at the same step, no step is taken after that
+	if bos.maxLength != bos.length {
+		t.Errorf("history of length %d after %d hypotheses are finished", bos.maxLength, len(hypotheses))
+	}
+	for _, h := range hypotheses {
+		if !h.Finished || len(h.Tokens) != 3 {
+			t.Errorf("hypothesis %+v", h)
+		}
+	}
+}
+
+func TestBeamSearchProcessors(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	hypotheses, err := llama2.BeamSearch(testConfig, w, nil, llama2.BeamSearchOptions{Width: 1, MaxTokens: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned := hypotheses[0].Tokens[0]
+
+	hypotheses, err = llama2.BeamSearch(testConfig, w, nil, llama2.BeamSearchOptions{Width: 3, MaxTokens: 20, Processors: llama2.LogitBias{banned: float32(math.Inf(-1))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hypotheses {
+		if slices.Contains(h.Tokens, banned) {
+			t.Errorf("banned token %d in %v", banned, h.Tokens)
+		}
+	}
+}
+
+func TestBeamSearchContextFull(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	if _, err := llama2.BeamSearch(testConfig, w, make([]int, testConfig.SeqLen), llama2.BeamSearchOptions{Width: 2, MaxTokens: 20}); err != llama2.ErrContextFull {
+		t.Errorf("got %v", err)
+	}
+}
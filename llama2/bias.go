@@ -0,0 +1,50 @@
+package llama2
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// LogitBias is added to logits of tokens before temperature, same as OpenAI `logit_bias`.
+// Bias of -Inf bans token completely.
+type LogitBias map[int]float32
+
+func (b LogitBias) Process(_ []int, logits []float32) {
+	for token, bias := range b {
+		logits[token] += bias
+	}
+}
+
+// Ban tokens of text.
+func (b LogitBias) Ban(vocab Vocab, text string) error {
+	tokens, err := vocab.TokenIDs(text)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		b[token] = float32(math.Inf(-1))
+	}
+	return nil
+}
+
+// Set bias from string `token:bias`, where token is either token id or text.
+func (b LogitBias) Set(vocab Vocab, s string) error {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return fmt.Errorf("logit bias(%s) is not in format token:bias", s)
+	}
+	bias, err := strconv.ParseFloat(s[i+1:], 32)
+	if err != nil {
+		return fmt.Errorf("logit bias(%s): %w", s, err)
+	}
+	tokens, err := vocab.TokenIDs(s[:i])
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		b[token] += float32(bias)
+	}
+	return nil
+}
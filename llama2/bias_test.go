@@ -0,0 +1,67 @@
+package llama2_test
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestVocabTokenIDs(t *testing.T) {
+	vocab := newTestModel().Vocab
+	tests := []struct {
+		s     string
+		exp   []int
+		isErr bool
+	}{
+		{s: "5", exp: []int{5}},
+		{s: "0", exp: []int{0}},
+		{s: "ab", exp: []int{3}},
+		{s: "x", exp: []int{vocab.EncodeWord("x")}},
+		{s: "abc", exp: []int{3, vocab.EncodeWord("c")}},
+		{s: "64", isErr: true},
+		{s: "-1", isErr: true},
+		{s: "", isErr: true},
+		{s: "a?", isErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.s, func(t *testing.T) {
+			tokens, err := vocab.TokenIDs(tc.s)
+			if (err != nil) != tc.isErr || !slices.Equal(tc.exp, tokens) {
+				t.Errorf("got %v %v, exp %v", tokens, err, tc.exp)
+			}
+		})
+	}
+}
+
+func TestLogitBias(t *testing.T) {
+	vocab := newTestModel().Vocab
+	c := vocab.EncodeWord("c")
+
+	bias := llama2.LogitBias{}
+	for _, s := range []string{"5:2", "ab:-1.5", "abc:1", "5:0.5"} {
+		if err := bias.Set(vocab, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bias.Ban(vocab, "7"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"5", "5:x", "99:1", "?:1"} {
+		if err := bias.Set(vocab, s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+	if err := bias.Ban(vocab, "?"); err == nil {
+		t.Error("expected error")
+	}
+
+	logits := make([]float32, len(vocab.Words))
+	bias.Process(nil, logits)
+	exp := make([]float32, len(vocab.Words))
+	exp[5], exp[3], exp[c], exp[7] = 2.5, -0.5, 1, float32(math.Inf(-1))
+	if !slices.Equal(exp, logits) {
+		t.Errorf("got %v, exp %v", logits, exp)
+	}
+}
@@ -16,3 +16,9 @@ func (c Config) KVDim() int { return (c.Dim * c.NumKVHeads) / c.NumHeads }
 
 // KVMul integer multiplier of the kv sharing in multiquery
 func (c Config) KVMul() int { return c.NumHeads / c.NumKVHeads }
+
+// RunStateBytes is memory of RunState, most of which is KV cache.
+func (c Config) RunStateBytes() int {
+	floats := 4*c.Dim + 2*c.HiddenDim + 2*c.KVDim() + c.NumHeads*c.SeqLen + c.VocabSize + 2*c.NumLayers*c.SeqLen*c.KVDim()
+	return 4 * floats
+}
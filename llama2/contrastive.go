@@ -0,0 +1,120 @@
+package llama2
+
+import (
+	"math"
+	"slices"
+
+	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
+)
+
+type ContrastiveOptions struct {
+	TopK       int             // number of the most likely candidates to choose from (default 4)
+	Alpha      float32         // weight of degeneration penalty, 0 is greedy decoding (0.6 works well)
+	MaxTokens  int             // maximum number of generated tokens
+	Processors LogitsProcessor // applied to logits before probabilities of candidates are computed (optional)
+}
+
+// ContrastiveSearch generates continuation of prompt deterministically, avoiding repetitions of greedy decoding.
+// Among TopK most likely candidates it picks one with the highest (1-Alpha) * probability - Alpha * penalty,
+// where degeneration penalty is maximum cosine similarity between hidden state of candidate and hidden states of all previous positions.
+// Hidden state is output of last layer after final RMSNorm, that is RunState.X after Transformer.
+// Each candidate is forwarded, so it takes TopK forward passes per token, and one more when not the most likely candidate is picked.
+// Picked token is passed to emit after each step, returning false stops search before forwarding it.
+// BOS (1) token ends search without being emitted.
+// See "A Contrastive Framework for Neural Text Generation" (https://arxiv.org/abs/2202.06417).
+func ContrastiveSearch(config Config, w TransformerWeights, prompt []int, opts ContrastiveOptions, emit func(token int) bool) {
+	if opts.TopK <= 0 {
+		opts.TopK = 4
+	}
+	dim := config.Dim
+
+	s := NewRunState(config)
+	hidden := make([]float32, config.SeqLen*dim) // (seq_len, dim) hidden states of positions in sequence
+	norms := make([]float32, config.SeqLen)
+	logits := make([]float32, config.VocabSize)
+	candidates := make([]int, 0, opts.TopK)
+
+	norm := func(x []float32) float32 {
+		var sum float32
+		for _, v := range x {
+			sum += v * v
+		}
+		return float32(math.Sqrt(float64(sum)))
+	}
+	forward := func(token, pos int) {
+		Transformer(token, pos, config, s, w)
+		copy(hidden[pos*dim:(pos+1)*dim], s.X)
+		norms[pos] = norm(s.X)
+	}
+
+	// BOS (1) token and prompt
+	pos := 0
+	for _, token := range append([]int{1}, prompt...) {
+		if pos == config.SeqLen {
+			return
+		}
+		forward(token, pos)
+		pos++
+	}
+	history := append(make([]int, 0, config.SeqLen), prompt...)
+	if opts.Processors != nil {
+		StartProcessor(opts.Processors, history)
+	}
+
+	for generated := 0; generated < opts.MaxTokens && pos < config.SeqLen; generated++ {
+		copy(logits, s.Logits)
+		if opts.Processors != nil {
+			opts.Processors.Process(history, logits)
+		}
+		nn.SoftMax(logits)
+
+		// the most likely candidates, in order of decreasing probability
+		candidates = candidates[:0]
+		for len(candidates) < opts.TopK && len(candidates) < len(logits) {
+			best := -1
+			for i, p := range logits {
+				if (best < 0 || p > logits[best]) && !slices.Contains(candidates, i) {
+					best = i
+				}
+			}
+			if logits[best] == 0 && len(candidates) > 0 {
+				break
+			}
+			candidates = append(candidates, best)
+		}
+
+		// the most likely candidate is forwarded last, so that when it is picked state is ready for the next step
+		next, bestScore, forwarded := -1, float32(math.Inf(-1)), -1
+		for i := len(candidates) - 1; i >= 0; i-- {
+			c := candidates[i]
+			Transformer(c, pos, config, s, w)
+			forwarded = c
+
+			penalty := float32(-1)
+			hNorm := norm(s.X)
+			for j := 0; j < pos; j++ {
+				h := hidden[j*dim : (j+1)*dim]
+				var dot float32
+				for k := range h {
+					dot += h[k] * s.X[k]
+				}
+				penalty = max(penalty, dot/max(hNorm*norms[j], 1e-12))
+			}
+			if score := (1-opts.Alpha)*logits[c] - opts.Alpha*penalty; score >= bestScore {
+				next, bestScore = c, score
+			}
+		}
+
+		if next == 1 || !emit(next) {
+			return
+		}
+		if next == forwarded {
+			copy(hidden[pos*dim:(pos+1)*dim], s.X)
+			norms[pos] = norm(s.X)
+		} else {
+			forward(next, pos)
+		}
+		pos++
+		history = append(history, next)
+	}
+}
@@ -0,0 +1,104 @@
+package llama2_test
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+// contrastiveSearch is reference implementation, that forwards whole sequence for each candidate.
+func contrastiveSearch(config llama2.Config, w llama2.TransformerWeights, prompt []int, k int, alpha float32, n int) (generated []int) {
+	// hidden states of all positions and logits of the last one
+	forward := func(tokens []int) ([][]float32, []float32) {
+		s := llama2.NewRunState(config)
+		var hidden [][]float32
+		for pos, token := range tokens {
+			llama2.Transformer(token, pos, config, s, w)
+			hidden = append(hidden, slices.Clone(s.X))
+		}
+		return hidden, slices.Clone(s.Logits)
+	}
+	cosine := func(a, b []float32) float32 {
+		var dot, na, nb float64
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+			na += float64(a[i]) * float64(a[i])
+			nb += float64(b[i]) * float64(b[i])
+		}
+		return float32(dot / math.Sqrt(na*nb))
+	}
+
+	tokens := append([]int{1}, prompt...)
+	for len(generated) < n {
+		hidden, p := forward(tokens)
+		softMax(p)
+
+		order := make([]int, len(p))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int {
+			if p[a] > p[b] {
+				return -1
+			}
+			if p[a] < p[b] {
+				return 1
+			}
+			return 0
+		})
+
+		next, bestScore := -1, float32(math.Inf(-1))
+		for _, c := range order[:k] {
+			h, _ := forward(append(slices.Clone(tokens), c))
+			penalty := float32(-1)
+			for _, prev := range hidden {
+				penalty = max(penalty, cosine(prev, h[len(h)-1]))
+			}
+			if score := (1-alpha)*p[c] - alpha*penalty; score > bestScore {
+				next, bestScore = c, score
+			}
+		}
+		if next == 1 {
+			break
+		}
+		generated = append(generated, next)
+		tokens = append(tokens, next)
+	}
+	return generated
+}
+
+func TestContrastiveSearch(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	prompt := []int{5, 17, 3}
+
+	for _, tc := range []struct {
+		k     int
+		alpha float32
+	}{
+		{k: 1, alpha: 0.6},
+		{k: 4, alpha: 0},
+		{k: 4, alpha: 0.6},
+		{k: 8, alpha: 0.3},
+	} {
+		t.Run(fmt.Sprintf("k_%d_alpha_%v", tc.k, tc.alpha), func(t *testing.T) {
+			expected := contrastiveSearch(testConfig, w, prompt, tc.k, tc.alpha, 20)
+			if tc.k == 1 || tc.alpha == 0 {
+				if greedy := greedyDecode(testConfig, w, prompt, 20); !slices.Equal(greedy, expected) {
+					t.Fatalf("reference %v is not greedy %v", expected, greedy)
+				}
+			}
+
+			var tokens []int
+			llama2.ContrastiveSearch(testConfig, w, prompt, llama2.ContrastiveOptions{TopK: tc.k, Alpha: tc.alpha, MaxTokens: 20}, func(token int) bool {
+				tokens = append(tokens, token)
+				return true
+			})
+			if !slices.Equal(expected, tokens) {
+				t.Errorf("got %v, exp %v", tokens, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package llama2
+
+// NewNGramBlockerWithHash lets tests force hash collisions.
+func NewNGramBlockerWithHash(n int, hash func(tokens []int) uint64) *NGramBlocker {
+	b := NewNGramBlocker(n)
+	b.hash = hash
+	return b
+}
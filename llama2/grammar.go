@@ -0,0 +1,494 @@
+package llama2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Grammar is context-free grammar in GBNF-like format, matched against bytes of text.
+//
+//	root   ::= "{" ws pair ("," ws pair)* "}"   # rule "root" is start
+//	pair   ::= "\"" [a-z]+ "\"" ws ":" ws value
+//	value  ::= [0-9]+ | "true" | "false"
+//	ws     ::= [ \t\n]*
+//
+// Supported are literals with escapes, character classes with ranges and negation, any character ".",
+// rule references, groups and repetitions "*", "+", "?". Comments start with "#".
+// Matching is by bytes, so character classes can have only ASCII characters. Left recursion is not supported.
+type Grammar struct {
+	rules [][]grammarAlternative
+	names []string
+	root  int
+}
+
+type grammarAlternative []grammarElement
+
+// grammarElement is either character or reference to rule
+type grammarElement struct {
+	rule   int // -1 for character
+	ranges [][2]byte
+	negate bool
+}
+
+func (e grammarElement) match(c byte) bool {
+	for _, r := range e.ranges {
+		if r[0] <= c && c <= r[1] {
+			return !e.negate
+		}
+	}
+	return e.negate
+}
+
+func ParseGrammar(src string) (*Grammar, error) {
+	p := grammarParser{src: src, g: &Grammar{}, ids: map[string]int{}, defined: map[string]bool{}}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	for _, name := range p.g.names {
+		if name != "" && !p.defined[name] {
+			return nil, fmt.Errorf("grammar: undefined rule(%s)", name)
+		}
+	}
+	root, ok := p.ids["root"]
+	if !ok {
+		return nil, errors.New("grammar: no root rule")
+	}
+	p.g.root = root
+	return p.g, nil
+}
+
+type grammarParser struct {
+	src     string
+	pos     int
+	g       *Grammar
+	ids     map[string]int
+	defined map[string]bool
+}
+
+func (p *grammarParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("grammar: at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// rule id by name, rules can be referenced before definition
+func (p *grammarParser) rule(name string) int {
+	if id, ok := p.ids[name]; ok {
+		return id
+	}
+	id := p.newRule(name)
+	p.ids[name] = id
+	return id
+}
+
+func (p *grammarParser) newRule(name string) int {
+	p.g.rules = append(p.g.rules, nil)
+	p.g.names = append(p.g.names, name)
+	return len(p.g.rules) - 1
+}
+
+func (p *grammarParser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isNameChar(c byte) bool {
+	return c == '-' || c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (p *grammarParser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// isRuleStart checks if rule definition `name ::=` is next
+func (p *grammarParser) isRuleStart() bool {
+	start := p.pos
+	defer func() { p.pos = start }()
+	if p.name() == "" {
+		return false
+	}
+	p.skipSpace()
+	return strings.HasPrefix(p.src[p.pos:], "::=")
+}
+
+func (p *grammarParser) parse() error {
+	for p.skipSpace(); p.pos < len(p.src); p.skipSpace() {
+		name := p.name()
+		if name == "" {
+			return p.errorf("expected rule name")
+		}
+		p.skipSpace()
+		if !strings.HasPrefix(p.src[p.pos:], "::=") {
+			return p.errorf("expected ::=")
+		}
+		p.pos += 3
+		if p.defined[name] {
+			return p.errorf("rule(%s) is defined twice", name)
+		}
+		p.defined[name] = true
+		alternatives, err := p.alternatives()
+		if err != nil {
+			return err
+		}
+		p.g.rules[p.rule(name)] = alternatives
+	}
+	return nil
+}
+
+func (p *grammarParser) alternatives() ([]grammarAlternative, error) {
+	var alternatives []grammarAlternative
+	for {
+		sequence, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, sequence)
+		if p.pos < len(p.src) && p.src[p.pos] == '|' {
+			p.pos++
+			continue
+		}
+		return alternatives, nil
+	}
+}
+
+func (p *grammarParser) sequence() (grammarAlternative, error) {
+	var sequence grammarAlternative
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) || p.src[p.pos] == '|' || p.src[p.pos] == ')' || p.isRuleStart() {
+			return sequence, nil
+		}
+
+		atom, err := p.atom()
+		if err != nil {
+			return nil, err
+		}
+
+		// repetitions are rewritten into new rules: R ::= atom R | ""
+		if p.pos < len(p.src) {
+			switch p.src[p.pos] {
+			case '*', '+':
+				star := p.newRule("")
+				p.g.rules[star] = []grammarAlternative{append(slices.Clone(atom), grammarElement{rule: star}), {}}
+				if p.src[p.pos] == '*' {
+					atom = nil
+				}
+				atom = append(atom, grammarElement{rule: star})
+				p.pos++
+			case '?':
+				optional := p.newRule("")
+				p.g.rules[optional] = []grammarAlternative{atom, {}}
+				atom = grammarAlternative{{rule: optional}}
+				p.pos++
+			}
+		}
+
+		sequence = append(sequence, atom...)
+	}
+}
+
+func (p *grammarParser) atom() (grammarAlternative, error) {
+	switch c := p.src[p.pos]; {
+	case c == '"':
+		p.pos++
+		var literal grammarAlternative
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			c, err := p.char()
+			if err != nil {
+				return nil, err
+			}
+			literal = append(literal, grammarElement{rule: -1, ranges: [][2]byte{{c, c}}})
+		}
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated literal")
+		}
+		p.pos++
+		return literal, nil
+	case c == '[':
+		p.pos++
+		e := grammarElement{rule: -1}
+		if p.pos < len(p.src) && p.src[p.pos] == '^' {
+			e.negate = true
+			p.pos++
+		}
+		for p.pos < len(p.src) && p.src[p.pos] != ']' {
+			lo, err := p.char()
+			if err != nil {
+				return nil, err
+			}
+			hi := lo
+			if p.pos+1 < len(p.src) && p.src[p.pos] == '-' && p.src[p.pos+1] != ']' {
+				p.pos++
+				if hi, err = p.char(); err != nil {
+					return nil, err
+				}
+			}
+			e.ranges = append(e.ranges, [2]byte{lo, hi})
+		}
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated character class")
+		}
+		p.pos++
+		return grammarAlternative{e}, nil
+	case c == '.':
+		p.pos++
+		return grammarAlternative{{rule: -1, negate: true}}, nil
+	case c == '(':
+		p.pos++
+		group := p.newRule("")
+		alternatives, err := p.alternatives()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		p.g.rules[group] = alternatives
+		return grammarAlternative{{rule: group}}, nil
+	case isNameChar(c):
+		return grammarAlternative{{rule: p.rule(p.name())}}, nil
+	default:
+		return nil, p.errorf("unexpected character(%q)", c)
+	}
+}
+
+// char of literal or character class, with escapes
+func (p *grammarParser) char() (byte, error) {
+	c := p.src[p.pos]
+	p.pos++
+	if c != '\\' {
+		return c, nil
+	}
+	if p.pos >= len(p.src) {
+		return 0, p.errorf("unterminated escape")
+	}
+	c = p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'n':
+		return '\n', nil
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case 'x':
+		if p.pos+2 > len(p.src) {
+			return 0, p.errorf("bad escape")
+		}
+		v, err := strconv.ParseUint(p.src[p.pos:p.pos+2], 16, 8)
+		if err != nil {
+			return 0, p.errorf("bad escape: %s", err)
+		}
+		p.pos += 2
+		return byte(v), nil
+	default:
+		return c, nil
+	}
+}
+
+// grammarStack is pushdown stack of positions in rules, top is the last.
+// Top of expanded stack is always character element, and empty stack means that grammar is matched.
+type grammarStack []grammarPos
+
+type grammarPos struct {
+	rule, alternative, element int
+}
+
+func (g *Grammar) element(p grammarPos) (grammarElement, bool) {
+	alternative := g.rules[p.rule][p.alternative]
+	if p.element >= len(alternative) {
+		return grammarElement{}, false
+	}
+	return alternative[p.element], true
+}
+
+// expand stack until character elements on top
+func (g *Grammar) expand(stack grammarStack, out []grammarStack, depth int) []grammarStack {
+	if depth > 1000 {
+		// left recursion
+		return out
+	}
+	if len(stack) == 0 {
+		return append(out, stack)
+	}
+	top := stack[len(stack)-1]
+	e, ok := g.element(top)
+	if !ok {
+		// end of alternative, continue with parent rule
+		return g.expand(stack[:len(stack)-1], out, depth+1)
+	}
+	if e.rule < 0 {
+		return append(out, stack)
+	}
+
+	// continuation after rule, which is omitted at the end of alternative so repetitions do not grow stack
+	base := append(grammarStack(nil), stack[:len(stack)-1]...)
+	if next := (grammarPos{top.rule, top.alternative, top.element + 1}); next.element < len(g.rules[top.rule][top.alternative]) {
+		base = append(base, next)
+	}
+	for a := range g.rules[e.rule] {
+		out = g.expand(append(base[:len(base):len(base)], grammarPos{e.rule, a, 0}), out, depth+1)
+	}
+	return out
+}
+
+// advance all stacks by one byte
+func (g *Grammar) advance(stacks []grammarStack, c byte) []grammarStack {
+	var out []grammarStack
+	for _, stack := range stacks {
+		if len(stack) == 0 {
+			continue
+		}
+		top := stack[len(stack)-1]
+		if e, _ := g.element(top); !e.match(c) {
+			continue
+		}
+		next := append(stack[:len(stack)-1:len(stack)-1], grammarPos{top.rule, top.alternative, top.element + 1})
+		out = g.expand(next, out, 0)
+	}
+	return dedupGrammarStacks(out)
+}
+
+func dedupGrammarStacks(stacks []grammarStack) []grammarStack {
+	if len(stacks) < 2 {
+		return stacks
+	}
+	seen := make(map[string]bool, len(stacks))
+	out := stacks[:0]
+	var key []byte
+	for _, stack := range stacks {
+		key = key[:0]
+		for _, p := range stack {
+			key = binary.AppendUvarint(key, uint64(p.rule))
+			key = binary.AppendUvarint(key, uint64(p.alternative))
+			key = binary.AppendUvarint(key, uint64(p.element))
+		}
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			out = append(out, stack)
+		}
+	}
+	return out
+}
+
+func (g *Grammar) start() []grammarStack {
+	var stacks []grammarStack
+	for a := range g.rules[g.root] {
+		stacks = g.expand(grammarStack{{g.root, a, 0}}, stacks, 0)
+	}
+	return dedupGrammarStacks(stacks)
+}
+
+// GrammarProcessor allows only tokens that keep generated text valid prefix of grammar.
+// BOS (1) token, which ends generation, is allowed only when grammar is fully matched.
+// It is Starter, grammar is matched from the start of each generation.
+type GrammarProcessor struct {
+	g      *Grammar
+	tokens grammarTokens
+	first  grammarTokens // tokens following BOS (1) token, without leading whitespace
+	stacks []grammarStack
+	generation
+}
+
+type grammarTokens struct {
+	text  [][]byte
+	order []int // tokens with text in lexicographical order, to match common prefixes once
+}
+
+func newGrammarTokens(vocab Vocab, prev int) grammarTokens {
+	t := grammarTokens{text: make([][]byte, len(vocab.Words))}
+	for i := range vocab.Words {
+		if t.text[i] = vocab.tokenBytes(prev, i); len(t.text[i]) > 0 {
+			t.order = append(t.order, i)
+		}
+	}
+	slices.SortFunc(t.order, func(a, b int) int { return bytes.Compare(t.text[a], t.text[b]) })
+	return t
+}
+
+func NewGrammarProcessor(g *Grammar, vocab Vocab) *GrammarProcessor {
+	return &GrammarProcessor{g: g, tokens: newGrammarTokens(vocab, 0), first: newGrammarTokens(vocab, 1), stacks: g.start()}
+}
+
+// Accepted reports whether generated text fully matches grammar.
+func (p *GrammarProcessor) Accepted() bool {
+	for _, stack := range p.stacks {
+		if len(stack) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *GrammarProcessor) Start(history []int) {
+	p.start(history)
+	p.stacks = p.g.start()
+}
+
+func (p *GrammarProcessor) Process(history []int, logits []float32) {
+	for i := p.advance(history); i < len(history); i++ {
+		tokens := p.tokens
+		if isFollowingBOS(history, i) {
+			tokens = p.first
+		}
+		for _, c := range tokens.text[history[i]] {
+			p.stacks = p.g.advance(p.stacks, c)
+		}
+	}
+
+	tokens := p.tokens
+	if isFollowingBOS(history, len(history)) {
+		tokens = p.first
+	}
+
+	// stacks after each byte of previous token, reused for common prefix with next token
+	allowed := make([]bool, len(tokens.text))
+	levels := [][]grammarStack{p.stacks}
+	var prev []byte
+	for _, token := range tokens.order {
+		text := tokens.text[token]
+		n := 0
+		for n < len(prev) && n < len(text) && prev[n] == text[n] {
+			n++
+		}
+		levels = levels[:min(n, len(levels)-1)+1]
+		for i := len(levels) - 1; i < len(text) && len(levels[i]) > 0; i++ {
+			levels = append(levels, p.g.advance(levels[i], text[i]))
+		}
+		allowed[token] = len(levels) == len(text)+1 && len(levels[len(text)]) > 0
+		prev = text
+	}
+	// BOS (1) token ends generation
+	allowed[1] = p.Accepted()
+
+	isAnyAllowed := false
+	for token, ok := range allowed {
+		if !ok {
+			logits[token] = float32(math.Inf(-1))
+		}
+		isAnyAllowed = isAnyAllowed || ok
+	}
+	if !isAnyAllowed {
+		// grammar can not continue, end generation
+		logits[1] = 0
+	}
+}
@@ -0,0 +1,126 @@
+package llama2_test
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestGrammarProcessor(t *testing.T) {
+	vocab := llama2.Vocab{Words: []string{"<unk>", "\n<s>\n", "\n</s>\n", "y", "e", "s", "n", "o", ",", " ", "1", "0", "yes", "no", ", ", "<0x0A>", " yes"}}
+	token := func(word string) int { return slices.Index(vocab.Words, word) }
+
+	g, err := llama2.ParseGrammar(`
+		# answer with number
+		root ::= ("yes" | "no") ", " num "\n"?
+		num  ::= [1-9] [0-9]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		history []string
+		allowed []string
+	}{
+		{history: nil, allowed: []string{"y", "n", "yes", "no"}},
+		{history: []string{"y"}, allowed: []string{"e"}},
+		{history: []string{"y", "e", "s"}, allowed: []string{",", ", "}},
+		{history: []string{"no", ","}, allowed: []string{" "}},
+		{history: []string{"no", ", "}, allowed: []string{"1"}},
+		{history: []string{"no", ", ", "1"}, allowed: []string{"1", "0", "<0x0A>", "\n<s>\n"}},
+		{history: []string{"no", ", ", "1", "<0x0A>"}, allowed: []string{"\n<s>\n"}},
+	}
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.history, "|"), func(t *testing.T) {
+			p := llama2.NewGrammarProcessor(g, vocab)
+
+			// prompt is not matched
+			history := []int{token("n"), token("o")}
+			logits := make([]float32, len(vocab.Words))
+			p.Process(history, logits)
+
+			for _, word := range tc.history {
+				history = append(history, token(word))
+			}
+			clear(logits)
+			p.Process(history, logits)
+
+			var allowed []string
+			for i, v := range logits {
+				if !math.IsInf(float64(v), -1) {
+					allowed = append(allowed, vocab.Words[i])
+				}
+			}
+			slices.Sort(allowed)
+			slices.Sort(tc.allowed)
+			if !slices.Equal(tc.allowed, allowed) {
+				t.Errorf("got %q, exp %q", allowed, tc.allowed)
+			}
+		})
+	}
+
+	t.Run("following BOS", func(t *testing.T) {
+		// sentencepiece decoder strips leading whitespace of token following BOS (1) token
+		p := llama2.NewGrammarProcessor(g, vocab)
+		logits := make([]float32, len(vocab.Words))
+		p.Process(nil, logits)
+		if math.IsInf(float64(logits[token(" yes")]), -1) {
+			t.Errorf("logits %v", logits)
+		}
+		clear(logits)
+		p.Process([]int{token(" yes")}, logits)
+		if math.IsInf(float64(logits[token(", ")]), -1) || !math.IsInf(float64(logits[token(" ")]), -1) {
+			t.Errorf("logits %v", logits)
+		}
+	})
+}
+
+func TestParseGrammarError(t *testing.T) {
+	for _, src := range []string{
+		`root ::= "abc`,
+		`root ::= [a-z`,
+		`root ::= ( "a" `,
+		`root ::= other`,
+		`notroot ::= "a"`,
+		`root ::= "a" root ::= "b"`,
+	} {
+		if _, err := llama2.ParseGrammar(src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+func TestGrammarProcessorSession(t *testing.T) {
+	m := newTestModel()
+	g, err := llama2.ParseGrammar(`root ::= [a-c]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := llama2.CompileRegex(`[a-c]+`, m.Vocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := regexp.MustCompile(`^[a-c]+$`)
+
+	for name, p := range map[string]llama2.LogitsProcessor{"grammar": llama2.NewGrammarProcessor(g, m.Vocab), "regex": llama2.NewRegexProcessor(re)} {
+		t.Run(name, func(t *testing.T) {
+			// the same processor constrains text generated by each call, prompt of the next call is not matched
+			s := llama2.NewSession(m)
+			for _, prompt := range []string{"", "zzz", "abc"} {
+				var out strings.Builder
+				if _, err := s.Generate(context.Background(), prompt, llama2.GenerateOptions{MaxTokens: 5, Processors: p, Output: &out}); err != nil {
+					t.Fatal(err)
+				}
+				if !valid.MatchString(out.String()) {
+					t.Errorf("prompt %q: %q does not match", prompt, out.String())
+				}
+			}
+		})
+	}
+}
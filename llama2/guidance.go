@@ -0,0 +1,63 @@
+package llama2
+
+// ClassifierFreeGuidance mixes logits of prompt with logits of negative prompt followed by the same generated tokens,
+// as uncond + Scale * (cond - uncond), moving generation away from negative prompt.
+// Scale 1 is no guidance, larger scale follows prompt more closely.
+// Negative prompt is forwarded in its own RunState, one more forward pass per generated token.
+// It should be first processor, since it expects raw logits of model.
+// It is Starter, negative prompt is followed by tokens generated since the start of each generation.
+type ClassifierFreeGuidance struct {
+	Scale float32
+
+	config   Config
+	w        TransformerWeights
+	s        RunState
+	negative []int
+	pos      int
+	generation
+}
+
+// NewClassifierFreeGuidance with empty negative prompt guides away from unconditional distribution.
+func NewClassifierFreeGuidance(config Config, w TransformerWeights, negativePrompt []int, scale float32) *ClassifierFreeGuidance {
+	return &ClassifierFreeGuidance{
+		Scale:    scale,
+		config:   config,
+		w:        w,
+		s:        NewRunState(config),
+		negative: negativePrompt,
+	}
+}
+
+func (g *ClassifierFreeGuidance) forward(token int) {
+	if g.pos < g.config.SeqLen {
+		Transformer(token, g.pos, g.config, g.s, g.w)
+	}
+	g.pos++
+}
+
+func (g *ClassifierFreeGuidance) Start(history []int) {
+	g.start(history)
+	g.pos = 0
+}
+
+func (g *ClassifierFreeGuidance) Process(history []int, logits []float32) {
+	// BOS (1) token and negative prompt are before generated text
+	if g.pos == 0 {
+		g.forward(1)
+		for _, token := range g.negative {
+			g.forward(token)
+		}
+	}
+	for i := g.advance(history); i < len(history); i++ {
+		g.forward(history[i])
+	}
+
+	// no room for negative prompt in context
+	if g.pos > g.config.SeqLen {
+		return
+	}
+
+	for i, uncond := range g.s.Logits {
+		logits[i] = uncond + g.Scale*(logits[i]-uncond)
+	}
+}
@@ -0,0 +1,47 @@
+package llama2_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestClassifierFreeGuidance(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	prompt := []int{5, 17, 3}
+	negative := []int{9, 8}
+	generated := []int{42, 7, 11}
+
+	// logits after each generated token, of sequence starting with given tokens
+	logitsOf := func(start []int) [][]float32 {
+		s := llama2.NewRunState(testConfig)
+		var out [][]float32
+		for pos, token := range append(append([]int{1}, start...), generated...) {
+			llama2.Transformer(token, pos, testConfig, s, w)
+			if pos >= len(start) {
+				out = append(out, slices.Clone(s.Logits))
+			}
+		}
+		return out
+	}
+	cond, uncond := logitsOf(prompt), logitsOf(negative)
+
+	for _, scale := range []float32{0, 1, 1.5} {
+		t.Run(fmt.Sprintf("scale_%v", scale), func(t *testing.T) {
+			g := llama2.NewClassifierFreeGuidance(testConfig, w, negative, scale)
+			for i := range cond {
+				logits := slices.Clone(cond[i])
+				g.Process(append(slices.Clone(prompt), generated[:i]...), logits)
+
+				for j := range logits {
+					exp := uncond[i][j] + scale*(cond[i][j]-uncond[i][j])
+					if logits[j] != exp {
+						t.Fatalf("step %d token %d: got %v, exp %v", i, j, logits[j], exp)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package llama2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// JSONSchemaGrammar compiles JSON Schema into grammar of compact JSON values that match it.
+// Supported are "type", "properties", "required", "items", "minItems", "maxItems", "minLength", "maxLength",
+// "enum", "const", "anyOf", "oneOf" and "$ref" to "#/$defs/" or "#/definitions/".
+// Objects have only listed properties, required first, in order of schema.
+// Numbers are limited to 15 digits, so that every value has finite length.
+func JSONSchemaGrammar(schema []byte) (*Grammar, error) {
+	src, err := JSONSchemaGBNF(schema)
+	if err != nil {
+		return nil, err
+	}
+	return ParseGrammar(src)
+}
+
+// JSONSchemaGBNF compiles JSON Schema into text of grammar, see JSONSchemaGrammar.
+func JSONSchemaGBNF(schema []byte) (string, error) {
+	var root jsonSchema
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return "", fmt.Errorf("json schema: %w", err)
+	}
+	c := jsonSchemaCompiler{root: &root, refs: map[string]string{}}
+	expr, err := c.compile(&root)
+	if err != nil {
+		return "", err
+	}
+	c.rule("root", expr)
+	for _, name := range []string{"value", "object", "array", "string", "char", "number", "integer", "boolean", "null", "ws"} {
+		if c.used[name] {
+			c.rule(name, jsonPrimitiveRules[name])
+		}
+	}
+	return c.out.String(), nil
+}
+
+var jsonPrimitiveRules = map[string]string{
+	"value":   `object | array | string | number | boolean | null`,
+	"object":  `"{" ws ( string ":" ws value ( "," ws string ":" ws value )* )? "}" ws`,
+	"array":   `"[" ws ( value ( "," ws value )* )? "]" ws`,
+	"string":  `"\"" char* "\"" ws`,
+	"char":    `[^"\\\x00-\x1f] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] )`,
+	"number":  `"-"? ( "0" | [1-9] [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? ) ( "." [0-9] [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? )? ( [eE] [-+]? [0-9] [0-9]? [0-9]? )? ws`,
+	"integer": `"-"? ( "0" | [1-9] [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? [0-9]? ) ws`,
+	"boolean": `( "true" | "false" ) ws`,
+	"null":    `"null" ws`,
+	"ws":      `" "?`,
+}
+
+// dependencies of primitive rules
+var jsonPrimitiveUses = map[string][]string{
+	"value":   {"object", "array", "string", "number", "boolean", "null"},
+	"object":  {"ws", "string", "value"},
+	"array":   {"ws", "value"},
+	"string":  {"char", "ws"},
+	"number":  {"ws"},
+	"integer": {"ws"},
+	"boolean": {"ws"},
+	"null":    {"ws"},
+}
+
+type jsonSchema struct {
+	Type        jsonSchemaTypes        `json:"type"`
+	Properties  jsonSchemaProperties   `json:"properties"`
+	Required    []string               `json:"required"`
+	Items       *jsonSchema            `json:"items"`
+	MinItems    *int                   `json:"minItems"`
+	MaxItems    *int                   `json:"maxItems"`
+	MinLength   *int                   `json:"minLength"`
+	MaxLength   *int                   `json:"maxLength"`
+	Enum        []json.RawMessage      `json:"enum"`
+	Const       json.RawMessage        `json:"const"`
+	AnyOf       []*jsonSchema          `json:"anyOf"`
+	OneOf       []*jsonSchema          `json:"oneOf"`
+	Ref         string                 `json:"$ref"`
+	Defs        map[string]*jsonSchema `json:"$defs"`
+	Definitions map[string]*jsonSchema `json:"definitions"`
+}
+
+// jsonSchemaTypes is either single type or list of types
+type jsonSchemaTypes []string
+
+func (t *jsonSchemaTypes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = []string{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+type jsonSchemaProperty struct {
+	Name   string
+	Schema *jsonSchema
+}
+
+// jsonSchemaProperties keeps order of properties in schema
+type jsonSchemaProperties []jsonSchemaProperty
+
+func (p *jsonSchemaProperties) UnmarshalJSON(b []byte) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("properties should be object")
+	}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		property := jsonSchemaProperty{Name: t.(string), Schema: &jsonSchema{}}
+		if err := d.Decode(property.Schema); err != nil {
+			return err
+		}
+		*p = append(*p, property)
+	}
+	return nil
+}
+
+type jsonSchemaCompiler struct {
+	root  *jsonSchema
+	out   strings.Builder
+	refs  map[string]string
+	used  map[string]bool
+	count int
+}
+
+func (c *jsonSchemaCompiler) rule(name, expr string) {
+	fmt.Fprintf(&c.out, "%s ::= %s\n", name, expr)
+}
+
+// use primitive rule with its dependencies
+func (c *jsonSchemaCompiler) use(name string) string {
+	if c.used == nil {
+		c.used = map[string]bool{}
+	}
+	if !c.used[name] {
+		c.used[name] = true
+		for _, dep := range jsonPrimitiveUses[name] {
+			c.use(dep)
+		}
+	}
+	return name
+}
+
+func (c *jsonSchemaCompiler) newRule(expr string) string {
+	c.count++
+	name := fmt.Sprintf("r%d", c.count)
+	c.rule(name, expr)
+	return name
+}
+
+func (c *jsonSchemaCompiler) compile(s *jsonSchema) (string, error) {
+	switch {
+	case s.Ref != "":
+		return c.ref(s.Ref)
+	case s.Const != nil:
+		return c.literal(s.Const)
+	case len(s.Enum) > 0:
+		var alternatives []string
+		for _, v := range s.Enum {
+			literal, err := c.literal(v)
+			if err != nil {
+				return "", err
+			}
+			alternatives = append(alternatives, literal)
+		}
+		return "( " + strings.Join(alternatives, " | ") + " )", nil
+	case len(s.AnyOf) > 0 || len(s.OneOf) > 0:
+		var alternatives []string
+		for _, sub := range append(s.AnyOf, s.OneOf...) {
+			expr, err := c.compile(sub)
+			if err != nil {
+				return "", err
+			}
+			alternatives = append(alternatives, expr)
+		}
+		return "( " + strings.Join(alternatives, " | ") + " )", nil
+	case len(s.Type) > 1:
+		var alternatives []string
+		for _, t := range s.Type {
+			sub := *s
+			sub.Type = []string{t}
+			expr, err := c.compile(&sub)
+			if err != nil {
+				return "", err
+			}
+			alternatives = append(alternatives, expr)
+		}
+		return "( " + strings.Join(alternatives, " | ") + " )", nil
+	case len(s.Type) == 0:
+		if len(s.Properties) > 0 {
+			return c.object(s)
+		}
+		if s.Items != nil {
+			return c.array(s)
+		}
+		return c.use("value"), nil
+	}
+
+	switch t := s.Type[0]; t {
+	case "object":
+		return c.object(s)
+	case "array":
+		return c.array(s)
+	case "string":
+		if s.MinLength == nil && s.MaxLength == nil {
+			return c.use("string"), nil
+		}
+		return `"\"" ` + c.repeat(c.use("char"), "", s.MinLength, s.MaxLength) + ` "\"" ` + c.use("ws"), nil
+	case "number", "integer", "boolean", "null":
+		return c.use(t), nil
+	default:
+		return "", fmt.Errorf("json schema: unsupported type(%s)", t)
+	}
+}
+
+func (c *jsonSchemaCompiler) ref(ref string) (string, error) {
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+	var defs map[string]*jsonSchema
+	var key string
+	switch {
+	case strings.HasPrefix(ref, "#/$defs/"):
+		defs, key = c.root.Defs, strings.TrimPrefix(ref, "#/$defs/")
+	case strings.HasPrefix(ref, "#/definitions/"):
+		defs, key = c.root.Definitions, strings.TrimPrefix(ref, "#/definitions/")
+	}
+	def, ok := defs[key]
+	if !ok {
+		return "", fmt.Errorf("json schema: unsupported $ref(%s)", ref)
+	}
+
+	// name is assigned before compilation, to allow recursive schemas
+	c.count++
+	name := fmt.Sprintf("r%d", c.count)
+	c.refs[ref] = name
+	expr, err := c.compile(def)
+	if err != nil {
+		return "", err
+	}
+	c.rule(name, expr)
+	return name, nil
+}
+
+// literal of JSON value in grammar
+func (c *jsonSchemaCompiler) literal(v json.RawMessage) (string, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, v); err != nil {
+		return "", err
+	}
+	return gbnfLiteral(compact.String()) + " " + c.use("ws"), nil
+}
+
+func gbnfLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func (c *jsonSchemaCompiler) object(s *jsonSchema) (string, error) {
+	if len(s.Properties) == 0 {
+		return c.use("object"), nil
+	}
+
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+
+	var requiredKVs, optionalKVs []string
+	for _, p := range s.Properties {
+		expr, err := c.compile(p.Schema)
+		if err != nil {
+			return "", err
+		}
+		name, _ := json.Marshal(p.Name)
+		kv := c.newRule(gbnfLiteral(string(name)) + " " + c.use("ws") + ` ":" ws ` + expr)
+		if required[p.Name] {
+			requiredKVs = append(requiredKVs, kv)
+		} else {
+			optionalKVs = append(optionalKVs, kv)
+		}
+	}
+
+	expr := `"{" ws`
+	if len(requiredKVs) > 0 {
+		expr += " " + strings.Join(requiredKVs, ` "," ws `)
+		for _, kv := range optionalKVs {
+			expr += ` ( "," ws ` + kv + ` )?`
+		}
+	} else if len(optionalKVs) > 0 {
+		// any of optional properties can be the first one, without comma
+		var alternatives []string
+		for i, kv := range optionalKVs {
+			alternative := kv
+			for _, next := range optionalKVs[i+1:] {
+				alternative += ` ( "," ws ` + next + ` )?`
+			}
+			alternatives = append(alternatives, alternative)
+		}
+		expr += " ( " + strings.Join(alternatives, " | ") + " )?"
+	}
+	return expr + ` "}" ws`, nil
+}
+
+func (c *jsonSchemaCompiler) array(s *jsonSchema) (string, error) {
+	item := c.use("value")
+	if s.Items != nil {
+		var err error
+		if item, err = c.compile(s.Items); err != nil {
+			return "", err
+		}
+		item = c.newRule(item)
+	}
+	return `"[" ws ` + c.repeat(item, `","`, s.MinItems, s.MaxItems) + ` "]" ws`, nil
+}
+
+// repeat item between min and max times (nil max = unbounded), with separator
+func (c *jsonSchemaCompiler) repeat(item, separator string, min, max *int) string {
+	lo, hi := 0, -1
+	if min != nil {
+		lo = *min
+	}
+	if max != nil {
+		hi = *max
+	}
+	sepItem := item
+	if separator != "" {
+		sepItem = "( " + separator + " ws " + item + " )"
+	}
+
+	if lo == 0 {
+		if hi == 0 {
+			return ""
+		}
+		rest := c.repeatOptional(sepItem, hi-1)
+		return "( " + item + " " + rest + " )?"
+	}
+
+	parts := []string{item}
+	for i := 1; i < lo; i++ {
+		parts = append(parts, sepItem)
+	}
+	if hi < 0 || hi > lo {
+		parts = append(parts, c.repeatOptional(sepItem, hi-lo))
+	}
+	return strings.Join(parts, " ")
+}
+
+// repeatOptional item up to n times (negative n = unbounded)
+func (c *jsonSchemaCompiler) repeatOptional(item string, n int) string {
+	if n < 0 {
+		return item + "*"
+	}
+	var expr string
+	for i := 0; i < n; i++ {
+		expr = "( " + item + " " + expr + " )?"
+	}
+	return expr
+}
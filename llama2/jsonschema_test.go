@@ -0,0 +1,103 @@
+package llama2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestJSONSchemaGrammar(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "maxLength": 5},
+			"age": {"type": "integer"},
+			"pet": {"enum": ["cat", "dog"]},
+			"tags": {"type": "array", "items": {"type": "boolean"}, "maxItems": 3}
+		},
+		"required": ["name", "age"]
+	}`)
+
+	words := []string{"<unk>", "\n<s>\n", "\n</s>\n", `{"`, `":`, `",`, `"}`, "name", "age", "pet", "tags", "cat", "dog", "true", "false", ` {"`, " true", "<0x7B>"}
+	for c := ' '; c <= '~'; c++ {
+		words = append(words, string(c))
+	}
+	vocab := llama2.Vocab{Words: words}
+
+	config := testConfig
+	config.VocabSize = len(words)
+	config.SeqLen = 256
+	w := newTestWeights(config, 1)
+
+	g, err := llama2.JSONSchemaGrammar(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seed := int64(0); seed < 50; seed++ {
+		t.Run(fmt.Sprintf("seed_%d", seed), func(t *testing.T) {
+			s := llama2.NewRunState(config)
+			processors := llama2.LogitsProcessors{llama2.NewGrammarProcessor(g, vocab)}
+			sampler := llama2.RandomSampler{Rand: rand.New(rand.NewSource(seed))}
+
+			var history []int
+			var out []byte
+			token := 1
+			for pos := 0; pos < config.SeqLen; pos++ {
+				llama2.Transformer(token, pos, config, s, w)
+				processors.Process(history, s.Logits)
+				prev := token
+				token = sampler.Sample(s.Logits)
+				if token == 1 {
+					break
+				}
+				history = append(history, token)
+				out = append(out, vocab.Decode(prev, token)...)
+			}
+			if token != 1 {
+				t.Skipf("not finished: %q", out)
+			}
+
+			var v struct {
+				Name *string `json:"name"`
+				Age  *int    `json:"age"`
+				Pet  *string `json:"pet"`
+				Tags []bool  `json:"tags"`
+			}
+			d := json.NewDecoder(bytes.NewReader(out))
+			d.DisallowUnknownFields()
+			if err := d.Decode(&v); err != nil {
+				t.Fatalf("%q: %s", out, err)
+			}
+			if v.Name == nil || v.Age == nil {
+				t.Errorf("%q: missing required", out)
+			}
+			if v.Name != nil && len([]rune(*v.Name)) > 5 {
+				t.Errorf("%q: name too long", out)
+			}
+			if v.Pet != nil && !slices.Contains([]string{"cat", "dog"}, *v.Pet) {
+				t.Errorf("%q: pet not in enum", out)
+			}
+			if len(v.Tags) > 3 {
+				t.Errorf("%q: too many tags", out)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaGrammarError(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": "object"`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"type": "unknown"}`,
+	} {
+		if _, err := llama2.JSONSchemaGrammar([]byte(schema)); err == nil {
+			t.Errorf("expected error for %s", schema)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package llama2
+
+import "math"
+
+// TokenLogProb is log-probability of token.
+type TokenLogProb struct {
+	Token   int     `json:"token"`
+	Text    string  `json:"text,omitempty"`
+	LogProb float32 `json:"logprob"`
+}
+
+// LogProbs of chosen token at one step of generation.
+type LogProbs struct {
+	TokenLogProb
+	Entropy float32        `json:"entropy"` // of whole distribution, in nats
+	Top     []TokenLogProb `json:"top"`     // most likely tokens, in descending order
+}
+
+// NewLogProbs computes log-probability of chosen token, its top n alternatives and entropy of distribution from logits.
+func NewLogProbs(logits []float32, token int, n int) LogProbs {
+	// log-sum-exp with max for numerical stability
+	maxv := logits[0]
+	for _, v := range logits {
+		maxv = max(maxv, v)
+	}
+	var sum float64
+	for _, v := range logits {
+		sum += math.Exp(float64(v - maxv))
+	}
+	lse := float64(maxv) + math.Log(sum)
+
+	lp := LogProbs{
+		TokenLogProb: TokenLogProb{Token: token, LogProb: float32(float64(logits[token]) - lse)},
+		Top:          make([]TokenLogProb, 0, n+1),
+	}
+
+	for i, v := range logits {
+		logp := float64(v) - lse
+		if p := math.Exp(logp); p > 0 {
+			lp.Entropy -= float32(p * logp)
+		}
+
+		// insert into sorted top n
+		if len(lp.Top) == n && (n == 0 || float32(logp) <= lp.Top[n-1].LogProb) {
+			continue
+		}
+		j := len(lp.Top)
+		lp.Top = append(lp.Top, TokenLogProb{})
+		for ; j > 0 && lp.Top[j-1].LogProb < float32(logp); j-- {
+			lp.Top[j] = lp.Top[j-1]
+		}
+		lp.Top[j] = TokenLogProb{Token: i, LogProb: float32(logp)}
+		lp.Top = lp.Top[:min(len(lp.Top), n)]
+	}
+
+	return lp
+}
+
+// LogitsSnapshot keeps copy of logits at its place in processors chain,
+// e.g. to compute log-probabilities after temperature but before truncation.
+type LogitsSnapshot struct {
+	Logits []float32
+}
+
+func (s *LogitsSnapshot) Process(_ []int, logits []float32) {
+	s.Logits = append(s.Logits[:0], logits...)
+}
@@ -0,0 +1,49 @@
+package llama2_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestNewLogProbs(t *testing.T) {
+	// softmax of [1 2 3 0] is exp(logit - log(e + e^2 + e^3 + 1))
+	logits := []float32{1, 2, 3, 0}
+	logp := []float32{-2.4401897, -1.4401897, -0.4401897, -3.4401897}
+	const entropy = 0.94753696
+
+	isClose := func(a, b float32) bool { return math.Abs(float64(a-b)) < 1e-5 }
+
+	tests := []struct {
+		token int
+		n     int
+		top   []int
+	}{
+		{token: 0, n: 0, top: nil},
+		{token: 1, n: 1, top: []int{2}},
+		{token: 3, n: 3, top: []int{2, 1, 0}},
+		{token: 2, n: 4, top: []int{2, 1, 0, 3}},
+		{token: 2, n: 10, top: []int{2, 1, 0, 3}},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("token_%d_n_%d", tc.token, tc.n), func(t *testing.T) {
+			lp := llama2.NewLogProbs(logits, tc.token, tc.n)
+			if lp.Token != tc.token || !isClose(lp.LogProb, logp[tc.token]) {
+				t.Errorf("got %+v, exp logprob %v", lp.TokenLogProb, logp[tc.token])
+			}
+			if !isClose(lp.Entropy, entropy) {
+				t.Errorf("entropy %v, exp %v", lp.Entropy, entropy)
+			}
+			if len(lp.Top) != len(tc.top) {
+				t.Fatalf("top %v, exp tokens %v", lp.Top, tc.top)
+			}
+			for i, token := range tc.top {
+				if lp.Top[i].Token != token || !isClose(lp.Top[i].LogProb, logp[token]) {
+					t.Errorf("top %d: got %+v, exp token %d logprob %v", i, lp.Top[i], token, logp[token])
+				}
+			}
+		})
+	}
+}
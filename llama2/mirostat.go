@@ -0,0 +1,75 @@
+package llama2
+
+import (
+	"math"
+	"math/rand"
+
+	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
+)
+
+// Mirostat v2 sampler keeps surprise of generated text close to target.
+// Tokens with surprise above running Mu are truncated, and Mu is adjusted
+// after each sample by difference between observed and target surprise.
+// Mu is state of single generation session, so each session needs own sampler.
+// https://arxiv.org/abs/2007.14966
+type Mirostat struct {
+	Tau float32 // target surprise, in bits
+	Eta float32 // learning rate of Mu
+	Mu  float32 // maximum surprise of token to sample
+
+	Rand *rand.Rand // source of randomness (optional; default is global)
+}
+
+func NewMirostat(tau, eta float32) *Mirostat {
+	return &Mirostat{Tau: tau, Eta: eta, Mu: 2 * tau}
+}
+
+func (m *Mirostat) Sample(logits []float32) int {
+	nn.SoftMax(logits)
+	probabilities := logits
+
+	// surprise -log2(p) <= mu is same as p >= 2^-mu
+	threshold := float32(math.Exp2(-float64(m.Mu)))
+
+	var sum float32
+	maxi := 0
+	for i, p := range probabilities {
+		if p >= threshold {
+			sum += p
+		}
+		if p > probabilities[maxi] {
+			maxi = i
+		}
+	}
+
+	// always keep at least most likely token
+	next := maxi
+	if sum > 0 {
+		r := m.random() * sum
+		var cdf float32
+		for i, p := range probabilities {
+			if p < threshold {
+				continue
+			}
+			next = i
+			if cdf += p; r < cdf {
+				break
+			}
+		}
+	} else {
+		sum = probabilities[maxi]
+	}
+
+	// observed surprise of sampled token in truncated distribution
+	surprise := -float32(math.Log2(float64(probabilities[next] / sum)))
+	m.Mu -= m.Eta * (surprise - m.Tau)
+
+	return next
+}
+
+func (m *Mirostat) random() float32 {
+	if m.Rand == nil {
+		return rand.Float32()
+	}
+	return m.Rand.Float32()
+}
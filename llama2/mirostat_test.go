@@ -0,0 +1,71 @@
+package llama2_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+// geometricLogits are of probabilities proportional to 2^-i, so surprise of token i is about i+1 bits.
+func geometricLogits(n int) []float32 {
+	logits := make([]float32, n)
+	for i := range logits {
+		logits[i] = -float32(i) * math.Ln2
+	}
+	return logits
+}
+
+func TestMirostatTruncation(t *testing.T) {
+	m := &llama2.Mirostat{Tau: 2, Eta: 0, Mu: 2.5, Rand: rand.New(rand.NewSource(1))}
+	counts := make([]int, 8)
+	for i := 0; i < 1000; i++ {
+		counts[m.Sample(geometricLogits(len(counts)))]++
+	}
+	// surprise of tokens 0 and 1 is about 1 and 2 bits, others are above Mu
+	if counts[0] == 0 || counts[1] == 0 || counts[0]+counts[1] != 1000 {
+		t.Errorf("counts %v", counts)
+	}
+	if m.Mu != 2.5 {
+		t.Errorf("Mu %v changed with zero learning rate", m.Mu)
+	}
+}
+
+// TestMirostatMu checks that Mu moves from far above and far below toward value where surprise of samples is Tau.
+func TestMirostatMu(t *testing.T) {
+	const tau = 1.5
+	for _, start := range []float32{20, 0} {
+		m := &llama2.Mirostat{Tau: tau, Eta: 0.1, Mu: start, Rand: rand.New(rand.NewSource(1))}
+
+		var surprise float64
+		const steps, last = 2000, 1000
+		for i := 0; i < steps; i++ {
+			logits := geometricLogits(32)
+			mu := m.Mu
+			token := m.Sample(logits)
+
+			// truncated distribution, most likely token is kept even when its surprise is above Mu
+			var sum float64
+			for _, p := range logits {
+				if s := -math.Log2(float64(p)); s <= float64(mu) {
+					sum += float64(p)
+				}
+			}
+			s := -math.Log2(float64(logits[token]))
+			if s > float64(mu) && token != 0 {
+				t.Fatalf("step %d: token %d of surprise %v above Mu %v", i, token, s, mu)
+			}
+			if i >= steps-last && sum > 0 {
+				surprise += -math.Log2(float64(logits[token]) / sum)
+			}
+		}
+
+		if mu := m.Mu; start > tau && mu > start/2 || start < tau && mu < tau {
+			t.Errorf("Mu %v did not move from %v", mu, start)
+		}
+		if surprise /= last; math.Abs(surprise-tau) > 0.25 {
+			t.Errorf("average surprise %v, exp %v", surprise, tau)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package llama2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
+)
+
+// Model is everything needed to generate text: architecture, weights and vocabulary.
+// Generation does not change it, so one model can be used by sessions on many goroutines at once.
+type Model struct {
+	Config  Config
+	Weights TransformerWeights
+	Vocab   Vocab
+
+	pool *nn.Pool // created by SetThreads, closed by its next call
+}
+
+// LoadModel reads checkpoint and tokenizer files of llama2.c.
+func LoadModel(checkpointPath, tokenizerPath string) (*Model, error) {
+	checkpointFile, err := os.Open(checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+	defer checkpointFile.Close()
+
+	tokenizerFile, err := os.Open(tokenizerPath)
+	if err != nil {
+		return nil, err
+	}
+	defer tokenizerFile.Close()
+
+	return NewModel(checkpointFile, tokenizerFile)
+}
+
+// NewModel reads checkpoint and tokenizer of llama2.c.
+func NewModel(checkpoint, tokenizer io.Reader) (*Model, error) {
+	config, err := NewConfigFromCheckpoint(checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config: %w", err)
+	}
+
+	// "negative vocab size is hacky way of signaling unsahred weights. biy yikes" — @karpathy
+	isSharedWeights := config.VocabSize > 0
+	if config.VocabSize < 0 {
+		config.VocabSize = -config.VocabSize
+	}
+
+	r := &errReader{r: checkpoint}
+	w := NewTransformerWeightsFromCheckpoint(config, r, isSharedWeights)
+	if r.err != nil {
+		return nil, fmt.Errorf("cannot read weights: %w", r.err)
+	}
+
+	r = &errReader{r: tokenizer}
+	vocab := NewVocabFromFile(config.VocabSize, r)
+	if r.err != nil {
+		return nil, fmt.Errorf("cannot read vocabulary: %w", r.err)
+	}
+
+	return &Model{Config: config, Weights: w, Vocab: vocab}, nil
+}
+
+// SetThreads makes forward pass of model run on its own pool of n goroutines (at least one),
+// instead of pool shared by all models, which is sized from GOMAXPROCS.
+// Pool created by previous call is closed, so it should not be called during generation.
+// Pool set to Weights.Pool by caller is not closed.
+func (m *Model) SetThreads(n int) {
+	if m.pool != nil {
+		m.pool.Close()
+	}
+	m.pool = nn.NewPool(max(n, 1))
+	m.Weights.Pool = m.pool
+}
+
+// errReader remembers the first error of reader, since readers of checkpoint do not return errors.
+// Complete input is read to its last byte but not further, so even io.EOF means input is truncated.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	if err != nil && n < len(p) {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,122 @@
+package llama2
+
+import (
+	"hash/maphash"
+	"math"
+	"slices"
+)
+
+// NGramBlocker forbids generating n-gram that is already present in history, as in `no_repeat_ngram_size`.
+// It keeps incremental index from (n-1)-gram to distinct tokens that followed it,
+// so cost of each step does not grow with length of history, only with number of such tokens.
+// History is expected to only grow between calls, so each session needs own blocker.
+// When history gets shorter than before, e.g. after Session.Reset, index is built again.
+// Index is kept in buffers that are reused once history gets shorter, so then it does not allocate.
+type NGramBlocker struct {
+	N         int
+	indexed   int // number of tokens of history in index
+	seed      maphash.Seed
+	index     map[uint64]int // hash of (n-1)-gram to the first of its bucket in prefixes
+	prefixes  []ngramPrefix
+	followers []ngramFollower
+	hash      func(tokens []int) uint64
+	buf       []byte
+}
+
+// ngramPrefix is (n-1)-gram with list of tokens that followed it, prefixes of same hash are listed in bucket of index.
+type ngramPrefix struct {
+	pos      int // of the first occurrence in history
+	next     int // in prefixes of the same bucket, -1 for the last one
+	follower int // the first in followers, -1 for none
+}
+
+type ngramFollower struct {
+	token int
+	next  int // in followers of the same prefix, -1 for the last one
+}
+
+func NewNGramBlocker(n int) *NGramBlocker {
+	b := &NGramBlocker{
+		N:     n,
+		seed:  maphash.MakeSeed(),
+		index: make(map[uint64]int),
+	}
+	b.hash = b.seededHash
+	return b
+}
+
+// Process adds new tokens of history to index and sets logits of tokens that would repeat existing n-gram to -Inf.
+func (b *NGramBlocker) Process(history []int, logits []float32) {
+	if b.N <= 0 {
+		return
+	}
+	if len(history) < b.indexed {
+		clear(b.index)
+		b.prefixes, b.followers, b.indexed = b.prefixes[:0], b.followers[:0], 0
+	}
+
+	for ; b.indexed < len(history); b.indexed++ {
+		if i := b.indexed; i >= b.N-1 {
+			b.follow(b.prefix(history, i-(b.N-1)), history[i])
+		}
+	}
+
+	if len(history) < b.N-1 {
+		return
+	}
+	if p := b.find(history, len(history)-(b.N-1)); p >= 0 {
+		for f := b.prefixes[p].follower; f >= 0; f = b.followers[f].next {
+			logits[b.followers[f].token] = float32(math.Inf(-1))
+		}
+	}
+}
+
+// find returns prefix that starts at pos of history, or -1 if it is not in index.
+func (b *NGramBlocker) find(history []int, pos int) int {
+	tokens := history[pos : pos+b.N-1]
+	p, ok := b.index[b.hash(tokens)]
+	if !ok {
+		return -1
+	}
+	for ; p >= 0; p = b.prefixes[p].next {
+		// resolve hash collisions
+		if start := b.prefixes[p].pos; slices.Equal(history[start:start+b.N-1], tokens) {
+			return p
+		}
+	}
+	return -1
+}
+
+// prefix returns prefix that starts at pos of history, adding it to index if it is not there yet.
+func (b *NGramBlocker) prefix(history []int, pos int) int {
+	if p := b.find(history, pos); p >= 0 {
+		return p
+	}
+	key := b.hash(history[pos : pos+b.N-1])
+	next, ok := b.index[key]
+	if !ok {
+		next = -1
+	}
+	b.prefixes = append(b.prefixes, ngramPrefix{pos: pos, next: next, follower: -1})
+	b.index[key] = len(b.prefixes) - 1
+	return len(b.prefixes) - 1
+}
+
+// follow adds token to followers of prefix p, if it is not there yet.
+func (b *NGramBlocker) follow(p int, token int) {
+	for f := b.prefixes[p].follower; f >= 0; f = b.followers[f].next {
+		if b.followers[f].token == token {
+			return
+		}
+	}
+	b.followers = append(b.followers, ngramFollower{token: token, next: b.prefixes[p].follower})
+	b.prefixes[p].follower = len(b.followers) - 1
+}
+
+func (b *NGramBlocker) seededHash(tokens []int) uint64 {
+	b.buf = b.buf[:0]
+	for _, token := range tokens {
+		b.buf = Endian.AppendUint64(b.buf, uint64(token))
+	}
+	return maphash.Bytes(b.seed, b.buf)
+}
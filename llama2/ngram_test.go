@@ -0,0 +1,96 @@
+package llama2_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestNGramBlocker(t *testing.T) {
+	collide := func([]int) uint64 { return 0 }
+
+	tests := []struct {
+		name    string
+		blocker *llama2.NGramBlocker
+		history []int
+		blocked []int
+	}{
+		{
+			name:    "repeat",
+			blocker: llama2.NewNGramBlocker(3),
+			history: []int{1, 2, 3, 4, 1, 2},
+			blocked: []int{3},
+		},
+		{
+			name:    "several followers",
+			blocker: llama2.NewNGramBlocker(2),
+			history: []int{5, 1, 5, 2, 5, 1, 5},
+			blocked: []int{1, 2},
+		},
+		{
+			name:    "no repeat",
+			blocker: llama2.NewNGramBlocker(3),
+			history: []int{1, 2, 3, 4, 2, 1},
+		},
+		{
+			name:    "unigram",
+			blocker: llama2.NewNGramBlocker(1),
+			history: []int{3, 3, 0, 6, 3},
+			blocked: []int{0, 3, 6},
+		},
+		{
+			name:    "hash collision",
+			blocker: llama2.NewNGramBlockerWithHash(3, collide),
+			history: []int{1, 2, 3, 4, 5, 6, 1, 2},
+			blocked: []int{3},
+		},
+		{
+			name:    "shorter than prefix",
+			blocker: llama2.NewNGramBlocker(4),
+			history: []int{1, 2},
+		},
+		{
+			name:    "off",
+			blocker: llama2.NewNGramBlocker(0),
+			history: []int{1, 1, 1},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// history grows by one token between calls, as in generation
+			logits := make([]float32, 8)
+			for i := range tc.history {
+				clear(logits)
+				tc.blocker.Process(tc.history[:i+1], logits)
+			}
+			for token, logit := range logits {
+				isBlocked := false
+				for _, b := range tc.blocked {
+					isBlocked = isBlocked || b == token
+				}
+				if isBlocked != math.IsInf(float64(logit), -1) {
+					t.Errorf("token %d: logit %v, blocked %v", token, logit, tc.blocked)
+				}
+			}
+		})
+	}
+}
+
+func TestNGramBlockerShorterHistory(t *testing.T) {
+	b := llama2.NewNGramBlocker(2)
+	logits := make([]float32, 8)
+	b.Process([]int{1, 2, 1}, logits)
+	if !math.IsInf(float64(logits[2]), -1) {
+		t.Fatalf("got %v", logits)
+	}
+
+	// history of new sequence does not contain 1 2
+	clear(logits)
+	b.Process([]int{1}, logits)
+	for token, logit := range logits {
+		if logit != 0 {
+			t.Errorf("token %d is blocked after history got shorter", token)
+		}
+	}
+}
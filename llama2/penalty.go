@@ -0,0 +1,42 @@
+package llama2
+
+// Penalties discourage model from repeating tokens from recent history.
+// They are applied to logits before temperature and softmax.
+type Penalties struct {
+	Window     int     // number of most recent tokens to consider (0 = whole history)
+	Repetition float32 // CTRL-style, divides positive and multiplies negative logits of seen tokens (1 = off)
+	Frequency  float32 // subtracted from logit for every occurrence of token (0 = off)
+	Presence   float32 // subtracted from logit once if token occurred at all (0 = off)
+
+	counts map[int]int // reused between calls
+}
+
+// Process applies penalties to logits based on tokens in history.
+func (p *Penalties) Process(history []int, logits []float32) {
+	isRepetition := p.Repetition != 0 && p.Repetition != 1
+	if !isRepetition && p.Frequency == 0 && p.Presence == 0 {
+		return
+	}
+	if p.Window > 0 && len(history) > p.Window {
+		history = history[len(history)-p.Window:]
+	}
+
+	if p.counts == nil {
+		p.counts = make(map[int]int, len(history))
+	}
+	clear(p.counts)
+	for _, token := range history {
+		p.counts[token]++
+	}
+
+	for token, count := range p.counts {
+		if isRepetition {
+			if logits[token] > 0 {
+				logits[token] /= p.Repetition
+			} else {
+				logits[token] *= p.Repetition
+			}
+		}
+		logits[token] -= float32(count)*p.Frequency + p.Presence
+	}
+}
@@ -0,0 +1,77 @@
+package llama2_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestPenalties(t *testing.T) {
+	tests := []struct {
+		name      string
+		penalties llama2.Penalties
+		history   []int
+		logits    []float32
+		exp       []float32
+	}{
+		{
+			name:      "repetition divides positive and multiplies negative",
+			penalties: llama2.Penalties{Repetition: 2},
+			history:   []int{0, 1, 1},
+			logits:    []float32{4, -4, 4, -4},
+			exp:       []float32{2, -8, 4, -4},
+		},
+		{
+			name:      "frequency multiplied by count",
+			penalties: llama2.Penalties{Frequency: 0.5},
+			history:   []int{0, 2, 2, 2},
+			logits:    []float32{1, 1, 1, 1},
+			exp:       []float32{0.5, 1, -0.5, 1},
+		},
+		{
+			name:      "presence applied once",
+			penalties: llama2.Penalties{Presence: 0.5},
+			history:   []int{0, 2, 2, 2},
+			logits:    []float32{1, 1, 1, 1},
+			exp:       []float32{0.5, 1, 0.5, 1},
+		},
+		{
+			name:      "all",
+			penalties: llama2.Penalties{Repetition: 2, Frequency: 1, Presence: 1},
+			history:   []int{3, 3},
+			logits:    []float32{1, 1, 1, 4},
+			exp:       []float32{1, 1, 1, -1},
+		},
+		{
+			name:      "window",
+			penalties: llama2.Penalties{Window: 2, Frequency: 1},
+			history:   []int{0, 0, 1, 2},
+			logits:    []float32{1, 1, 1, 1},
+			exp:       []float32{1, 0, 0, 1},
+		},
+		{
+			name:      "window longer than history",
+			penalties: llama2.Penalties{Window: 10, Frequency: 1},
+			history:   []int{0, 1},
+			logits:    []float32{1, 1, 1, 1},
+			exp:       []float32{0, 0, 1, 1},
+		},
+		{
+			name:      "off",
+			penalties: llama2.Penalties{Repetition: 1},
+			history:   []int{0, 1},
+			logits:    []float32{1, -1, 1, 1},
+			exp:       []float32{1, -1, 1, 1},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logits := slices.Clone(tc.logits)
+			tc.penalties.Process(tc.history, logits)
+			if !slices.Equal(tc.exp, logits) {
+				t.Errorf("got %v, exp %v", logits, tc.exp)
+			}
+		})
+	}
+}
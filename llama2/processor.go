@@ -0,0 +1,125 @@
+package llama2
+
+import (
+	"math"
+
+	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
+)
+
+// LogitsProcessor modifies logits of next token before sampling, given history of prompt and generated tokens.
+type LogitsProcessor interface {
+	Process(history []int, logits []float32)
+}
+
+// LogitsProcessors is ordered chain of processors.
+type LogitsProcessors []LogitsProcessor
+
+func (c LogitsProcessors) Process(history []int, logits []float32) {
+	for _, p := range c {
+		p.Process(history, logits)
+	}
+}
+
+// Start starts processors of chain that are Starter.
+func (c LogitsProcessors) Start(history []int) {
+	for _, p := range c {
+		StartProcessor(p, history)
+	}
+}
+
+// Starter is LogitsProcessor that keeps state of generated text, e.g. to match it against grammar.
+// Start is called with history of prompt before the first Process of each generation, and resets that state.
+// Without Start, generated text starts after history of the first Process.
+// Session.Generate calls Start, so the same processor can be passed to every Generate of session, but not of sessions at once.
+type Starter interface {
+	LogitsProcessor
+	Start(history []int)
+}
+
+// StartProcessor calls Start of p when it is Starter.
+func StartProcessor(p LogitsProcessor, history []int) {
+	if s, ok := p.(Starter); ok {
+		s.Start(history)
+	}
+}
+
+// generation tracks tokens of history that were generated, for Starter.
+type generation struct {
+	started  bool
+	consumed int // tokens of history seen by Process
+}
+
+func (g *generation) start(history []int) { g.started, g.consumed = true, len(history) }
+
+// advance returns index in history of the first token generated since the last call, generation starts at first call unless started.
+func (g *generation) advance(history []int) int {
+	if !g.started {
+		g.start(history)
+	}
+	i := g.consumed
+	g.consumed = len(history)
+	return i
+}
+
+// Temperature divides logits, higher temperature makes distribution flatter.
+type Temperature float32
+
+func (t Temperature) Process(_ []int, logits []float32) {
+	for i := range logits {
+		logits[i] /= float32(t)
+	}
+}
+
+// Truncation removes unlikely tokens from distribution by setting their logits to -Inf.
+// Truncate is given probabilities of logits and should set probabilities of removed tokens to zero.
+type Truncation struct {
+	Truncate      func(probabilities []float32)
+	probabilities []float32
+}
+
+func (t *Truncation) Process(_ []int, logits []float32) {
+	t.probabilities = append(t.probabilities[:0], logits...)
+	nn.SoftMax(t.probabilities)
+	t.Truncate(t.probabilities)
+	for i, p := range t.probabilities {
+		if p == 0 {
+			logits[i] = float32(math.Inf(-1))
+		}
+	}
+}
+
+// TopK keeps only k most likely tokens.
+func TopK(k int) *Truncation {
+	var t nn.Truncator[float32]
+	return &Truncation{Truncate: func(probabilities []float32) { t.TopK(probabilities, k) }}
+}
+
+// MinP keeps only tokens with probability at least minp fraction of the most likely token.
+func MinP(minp float32) *Truncation {
+	return &Truncation{Truncate: func(probabilities []float32) { nn.MinP(probabilities, minp) }}
+}
+
+// TopP ("top-p" sampling, or "nucleus sampling") keeps the smallest set of most likely tokens
+// with cumulative probability exceeding topp.
+func TopP(topp float32) *Truncation {
+	var t nn.Truncator[float32]
+	return &Truncation{Truncate: func(probabilities []float32) { t.TopP(probabilities, topp) }}
+}
+
+// Typical keeps locally typical tokens up to probability mass.
+func Typical(mass float32) *Truncation {
+	var t nn.Truncator[float32]
+	return &Truncation{Truncate: func(probabilities []float32) { t.Typical(probabilities, mass) }}
+}
+
+// TailFree cuts off tail of distribution by second derivative of sorted probabilities.
+func TailFree(z float32) *Truncation {
+	var t nn.Truncator[float32]
+	return &Truncation{Truncate: func(probabilities []float32) { t.TailFree(probabilities, z) }}
+}
+
+// Eta keeps tokens with probability above entropy-dependent threshold.
+func Eta(eta float32) *Truncation {
+	var t nn.Truncator[float32]
+	return &Truncation{Truncate: func(probabilities []float32) { t.Eta(probabilities, eta) }}
+}
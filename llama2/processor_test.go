@@ -0,0 +1,124 @@
+package llama2_test
+
+import (
+	"cmp"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+type recordProcessor struct {
+	name  string
+	calls *[]string
+}
+
+func (p recordProcessor) Process(_ []int, logits []float32) {
+	*p.calls = append(*p.calls, p.name)
+}
+
+func TestLogitsProcessorsOrder(t *testing.T) {
+	var calls []string
+	processors := llama2.LogitsProcessors{
+		recordProcessor{name: "a", calls: &calls},
+		recordProcessor{name: "b", calls: &calls},
+		recordProcessor{name: "c", calls: &calls},
+	}
+	processors.Process(nil, nil)
+	if exp := []string{"a", "b", "c"}; !slices.Equal(exp, calls) {
+		t.Errorf("got %v, exp %v", calls, exp)
+	}
+
+	// bias and temperature do not commute
+	logits := []float32{1, 2}
+	llama2.LogitsProcessors{llama2.LogitBias{0: 1}, llama2.Temperature(2)}.Process(nil, logits)
+	if exp := []float32{1, 1}; !slices.Equal(exp, logits) {
+		t.Errorf("bias then temperature: got %v, exp %v", logits, exp)
+	}
+	logits = []float32{1, 2}
+	llama2.LogitsProcessors{llama2.Temperature(2), llama2.LogitBias{0: 1}}.Process(nil, logits)
+	if exp := []float32{1.5, 1}; !slices.Equal(exp, logits) {
+		t.Errorf("temperature then bias: got %v, exp %v", logits, exp)
+	}
+}
+
+// sampleTopP is sampling of main loop before processors: from the smallest set of most likely tokens
+// with cumulative probability exceeding topp.
+func sampleTopP(probabilities []float32, topp float32, rnd *rand.Rand) int {
+	sorted := make([]int, len(probabilities))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	slices.SortStableFunc(sorted, func(a, b int) int { return cmp.Compare(probabilities[b], probabilities[a]) })
+	var cumulative float32
+	for i, token := range sorted {
+		cumulative += probabilities[token]
+		if cumulative > topp {
+			sorted = sorted[:i+1]
+			break
+		}
+	}
+	r := rnd.Float32() * cumulative
+	var cdf float32
+	for _, token := range sorted {
+		if cdf += probabilities[token]; r < cdf {
+			return token
+		}
+	}
+	return sorted[len(sorted)-1]
+}
+
+// Temperature and TopP processors followed by sampler sample from the same distribution
+// as dividing logits by temperature and sampling from nucleus.
+func TestTemperatureTopP(t *testing.T) {
+	logits := []float32{2, 1.5, 1, 0.5, 0, -0.5, -1, -3}
+	const n = 50000
+
+	for _, tc := range []struct {
+		temperature, topp float32
+	}{
+		{temperature: 1, topp: 0.9},
+		{temperature: 0.5, topp: 0.9},
+		{temperature: 2, topp: 0.7},
+		{temperature: 1.2, topp: 0.5},
+	} {
+		// distribution of tokens as sampled before processors
+		probabilities := slices.Clone(logits)
+		for i := range probabilities {
+			probabilities[i] /= tc.temperature
+		}
+		softMax(probabilities)
+		rnd := rand.New(rand.NewSource(2))
+		expected := make([]float64, len(logits))
+		for i := 0; i < n; i++ {
+			expected[sampleTopP(probabilities, tc.topp, rnd)]++
+		}
+
+		processors := llama2.LogitsProcessors{llama2.Temperature(tc.temperature), llama2.TopP(tc.topp)}
+		processed := slices.Clone(logits)
+		processors.Process(nil, processed)
+		for i, l := range processed {
+			if math.IsInf(float64(l), -1) != (expected[i] == 0) {
+				t.Errorf("temperature %v topp %v: token %d has logit %v and was sampled %v times before", tc.temperature, tc.topp, i, l, expected[i])
+			}
+		}
+
+		sampler := llama2.RandomSampler{Rand: rand.New(rand.NewSource(1))}
+		counts := make([]float64, len(logits))
+		for i := 0; i < n; i++ {
+			counts[sampler.Sample(slices.Clone(processed))]++
+		}
+		for i := range expected {
+			expected[i] /= n
+		}
+		var tv float64
+		for i := range counts {
+			tv += math.Abs(counts[i]/n-expected[i]) / 2
+		}
+		if tv > 0.02 {
+			t.Errorf("temperature %v topp %v: distance %f, got %v, exp %v", tc.temperature, tc.topp, tv, counts, expected)
+		}
+	}
+}
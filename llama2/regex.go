@@ -0,0 +1,393 @@
+package llama2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp/syntax"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxRegexStates limits size of DFA, since subset construction can be exponential.
+const maxRegexStates = 4096
+
+// byteSet is set of bytes as bitmap.
+type byteSet [4]uint64
+
+func (s *byteSet) add(lo, hi int) {
+	for c := lo; c <= hi; c++ {
+		s[c/64] |= 1 << (c % 64)
+	}
+}
+
+func (s *byteSet) has(c byte) bool { return s[c/64]&(1<<(c%64)) != 0 }
+
+// regexNode is state of NFA over bytes.
+// It either consumes byte from set and goes to next, or has epsilon transitions.
+type regexNode struct {
+	set  byteSet
+	next int
+	eps  []int
+}
+
+type regexCompiler struct {
+	nodes []regexNode
+}
+
+func (c *regexCompiler) node(n regexNode) int {
+	c.nodes = append(c.nodes, n)
+	return len(c.nodes) - 1
+}
+
+func (c *regexCompiler) bytes(set byteSet, next int) int {
+	return c.node(regexNode{set: set, next: next})
+}
+
+func (c *regexCompiler) eps(next ...int) int { return c.node(regexNode{next: -1, eps: next}) }
+
+// utf8 appends to alternatives NFA that matches UTF-8 encoding of any rune from lo to hi.
+// Range is split until each byte of encoding is in range of its own, as in RE2.
+func (c *regexCompiler) utf8(lo, hi rune, next int, alternatives []int) []int {
+	hi = min(hi, unicode.MaxRune)
+	if lo > hi {
+		return alternatives
+	}
+	// split at lengths of encoding and at surrogates, which are not valid in UTF-8
+	for _, b := range [...]rune{0x7F, 0x7FF, 0xD7FF, 0xDFFF, 0xFFFF} {
+		if lo <= b && b < hi {
+			return c.utf8(b+1, hi, next, c.utf8(lo, b, next, alternatives))
+		}
+	}
+	if 0xD800 <= lo && hi <= 0xDFFF {
+		return alternatives
+	}
+	for i := 1; i < utf8.RuneLen(lo); i++ {
+		m := rune(1)<<(6*i) - 1 // continuation bytes after i-th from the end
+		if lo&^m == hi&^m {
+			continue
+		}
+		if lo&m != 0 {
+			return c.utf8((lo|m)+1, hi, next, c.utf8(lo, lo|m, next, alternatives))
+		}
+		if hi&m != m {
+			return c.utf8(hi&^m, hi, next, c.utf8(lo, (hi&^m)-1, next, alternatives))
+		}
+	}
+	a, b := utf8.AppendRune(nil, lo), utf8.AppendRune(nil, hi)
+	for j := len(a) - 1; j >= 0; j-- {
+		var set byteSet
+		set.add(int(a[j]), int(b[j]))
+		next = c.bytes(set, next)
+	}
+	return append(alternatives, next)
+}
+
+// class matches UTF-8 encoding of any rune of ranges, which are pairs of lo and hi as in syntax.Regexp.
+func (c *regexCompiler) class(ranges []rune, next int) int {
+	var set byteSet
+	var alternatives []int
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo < utf8.RuneSelf {
+			set.add(int(lo), int(min(hi, utf8.RuneSelf-1)))
+		}
+		alternatives = c.utf8(max(lo, utf8.RuneSelf), hi, next, alternatives)
+	}
+	if len(alternatives) == 0 {
+		return c.bytes(set, next)
+	}
+	return c.eps(append(alternatives, c.bytes(set, next))...)
+}
+
+// isEmptyWidth reports whether re matches only empty text.
+func isEmptyWidth(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		return true
+	}
+	return false
+}
+
+// compile adds NFA that matches re and then continues to next.
+// Whole text is matched, so anchors are supported only where re is at its start (begin) or end (end).
+func (c *regexCompiler) compile(re *syntax.Regexp, next int, begin, end bool) (int, error) {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return c.bytes(byteSet{}, next), nil
+	case syntax.OpEmptyMatch:
+		return c.eps(next), nil
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		if !begin {
+			return 0, fmt.Errorf("regex: %s is supported only at start", re)
+		}
+		return c.eps(next), nil
+	case syntax.OpEndLine, syntax.OpEndText:
+		if !end {
+			return 0, fmt.Errorf("regex: %s is supported only at end", re)
+		}
+		return c.eps(next), nil
+	case syntax.OpLiteral:
+		for i := len(re.Rune) - 1; i >= 0; i-- {
+			ranges := []rune{re.Rune[i], re.Rune[i]}
+			if re.Flags&syntax.FoldCase != 0 {
+				for r := unicode.SimpleFold(re.Rune[i]); r != re.Rune[i]; r = unicode.SimpleFold(r) {
+					ranges = append(ranges, r, r)
+				}
+			}
+			next = c.class(ranges, next)
+		}
+		return next, nil
+	case syntax.OpCharClass:
+		return c.class(re.Rune, next), nil
+	case syntax.OpAnyChar:
+		return c.class([]rune{0, unicode.MaxRune}, next), nil
+	case syntax.OpAnyCharNotNL:
+		return c.class([]rune{0, '\n' - 1, '\n' + 1, unicode.MaxRune}, next), nil
+	case syntax.OpCapture:
+		return c.compile(re.Sub[0], next, begin, end)
+	case syntax.OpStar, syntax.OpPlus:
+		loop := c.eps()
+		body, err := c.compile(re.Sub[0], loop, false, false)
+		if err != nil {
+			return 0, err
+		}
+		c.nodes[loop].eps = []int{body, next}
+		if re.Op == syntax.OpPlus {
+			return body, nil
+		}
+		return loop, nil
+	case syntax.OpQuest:
+		body, err := c.compile(re.Sub[0], next, begin, end)
+		if err != nil {
+			return 0, err
+		}
+		return c.eps(body, next), nil
+	case syntax.OpConcat:
+		for i := len(re.Sub) - 1; i >= 0; i-- {
+			isBegin := begin && !slices.ContainsFunc(re.Sub[:i], func(sub *syntax.Regexp) bool { return !isEmptyWidth(sub) })
+			isEnd := end && !slices.ContainsFunc(re.Sub[i+1:], func(sub *syntax.Regexp) bool { return !isEmptyWidth(sub) })
+			var err error
+			if next, err = c.compile(re.Sub[i], next, isBegin, isEnd); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	case syntax.OpAlternate:
+		alternatives := make([]int, len(re.Sub))
+		for i, sub := range re.Sub {
+			var err error
+			if alternatives[i], err = c.compile(sub, next, begin, end); err != nil {
+				return 0, err
+			}
+		}
+		return c.eps(alternatives...), nil
+	default:
+		return 0, fmt.Errorf("regex: unsupported %s", re)
+	}
+}
+
+// Regex is regular expression compiled to DFA over bytes of text,
+// together with tokens of vocabulary that are allowed in each DFA state.
+// Whole generated text has to match, as if expression was anchored by ^ and $.
+// Syntax is of regexp package. Word boundaries are not supported, and ^ and $ only at start and end of expression.
+// It is not changed by processors, so it can be shared by them.
+type Regex struct {
+	next    [][256]int32 // DFA transitions, -1 when text can not match anymore
+	accept  []bool
+	allowed [][]uint64 // bitmap of allowed tokens in each state
+	tokens  [][]byte
+	first   [][]byte // tokens following BOS (1) token, without leading whitespace
+}
+
+func CompileRegex(expr string, vocab Vocab) (*Regex, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("regex: %w", err)
+	}
+
+	var c regexCompiler
+	match := c.eps()
+	start, err := c.compile(re.Simplify(), match, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// closure of NFA nodes, keeping only nodes that consume bytes and match
+	closure := func(nodes []int) []int {
+		var out []int
+		visited := make([]bool, len(c.nodes))
+		for len(nodes) > 0 {
+			n := nodes[len(nodes)-1]
+			nodes = nodes[:len(nodes)-1]
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			if c.nodes[n].next >= 0 || n == match {
+				out = append(out, n)
+			}
+			nodes = append(nodes, c.nodes[n].eps...)
+		}
+		slices.Sort(out)
+		return out
+	}
+
+	// subset construction, DFA state is set of NFA nodes
+	r := &Regex{}
+	var sets [][]int
+	index := map[string]int32{}
+	var key []byte
+	state := func(nodes []int) (int32, error) {
+		if len(nodes) == 0 {
+			return -1, nil
+		}
+		key = key[:0]
+		for _, n := range nodes {
+			key = binary.AppendUvarint(key, uint64(n))
+		}
+		if s, ok := index[string(key)]; ok {
+			return s, nil
+		}
+		if len(sets) == maxRegexStates {
+			return 0, fmt.Errorf("regex: more than %d states", maxRegexStates)
+		}
+		index[string(key)] = int32(len(sets))
+		sets = append(sets, nodes)
+		r.next = append(r.next, [256]int32{})
+		r.accept = append(r.accept, slices.Contains(nodes, match))
+		return int32(len(sets) - 1), nil
+	}
+
+	if _, err := state(closure([]int{start})); err != nil {
+		return nil, err
+	}
+	var targets []int
+	for s := 0; s < len(sets); s++ {
+		for b := 0; b < 256; b++ {
+			targets = targets[:0]
+			for _, n := range sets[s] {
+				if node := c.nodes[n]; node.next >= 0 && node.set.has(byte(b)) {
+					targets = append(targets, node.next)
+				}
+			}
+			if r.next[s][b], err = state(closure(targets)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// states from which text can not match anymore are dead
+	live := slices.Clone(r.accept)
+	for changed := true; changed; {
+		changed = false
+		for s := range r.next {
+			for _, t := range r.next[s] {
+				if !live[s] && t >= 0 && live[t] {
+					live[s], changed = true, true
+				}
+			}
+		}
+	}
+	for s := range r.next {
+		for b, t := range r.next[s] {
+			if t >= 0 && !live[t] {
+				r.next[s][b] = -1
+			}
+		}
+	}
+
+	r.tokens, r.first = make([][]byte, len(vocab.Words)), make([][]byte, len(vocab.Words))
+	for i := range vocab.Words {
+		r.tokens[i], r.first[i] = vocab.tokenBytes(0, i), vocab.tokenBytes(1, i)
+	}
+	r.allowed = make([][]uint64, len(r.next))
+	for s := range r.next {
+		r.allowed[s] = make([]uint64, (len(r.tokens)+63)/64)
+		if !live[s] {
+			continue
+		}
+		for token, text := range r.tokens {
+			if len(text) > 0 && r.walk(int32(s), text) >= 0 {
+				r.allowed[s][token/64] |= 1 << (token % 64)
+			}
+		}
+	}
+	return r, nil
+}
+
+// walk returns DFA state after text, or -1 when it can not match.
+func (r *Regex) walk(state int32, text []byte) int32 {
+	for _, c := range text {
+		if state < 0 {
+			break
+		}
+		state = r.next[state][c]
+	}
+	return state
+}
+
+// RegexProcessor allows only tokens that keep generated text valid prefix of text matching regex.
+// BOS (1) token, which ends generation, is allowed only when regex is fully matched.
+// It is Starter, regex is matched from the start of each generation.
+type RegexProcessor struct {
+	re    *Regex
+	first []uint64 // bitmap of allowed tokens following BOS (1) token, computed on demand
+	state int32
+	generation
+}
+
+func NewRegexProcessor(re *Regex) *RegexProcessor { return &RegexProcessor{re: re} }
+
+// Accepted reports whether generated text fully matches regex.
+func (p *RegexProcessor) Accepted() bool { return p.state >= 0 && p.re.accept[p.state] }
+
+func (p *RegexProcessor) Start(history []int) {
+	p.start(history)
+	p.state = 0
+}
+
+func (p *RegexProcessor) Process(history []int, logits []float32) {
+	for i := p.advance(history); i < len(history); i++ {
+		tokens := p.re.tokens
+		if isFollowingBOS(history, i) {
+			tokens = p.re.first
+		}
+		p.state = p.re.walk(p.state, tokens[history[i]])
+	}
+
+	if p.state < 0 {
+		// generated text does not match, end generation
+		for token := range logits {
+			logits[token] = float32(math.Inf(-1))
+		}
+		logits[1] = 0
+		return
+	}
+
+	allowed := p.re.allowed[p.state]
+	if isFollowingBOS(history, len(history)) {
+		p.first = make([]uint64, len(allowed))
+		for token, text := range p.re.first {
+			if len(text) > 0 && p.re.walk(p.state, text) >= 0 {
+				p.first[token/64] |= 1 << (token % 64)
+			}
+		}
+		allowed = p.first
+	}
+	accepted := p.Accepted()
+	isAnyAllowed := false
+	for token := range logits {
+		// BOS (1) token ends generation
+		if allowed[token/64]&(1<<(token%64)) == 0 && (token != 1 || !accepted) {
+			logits[token] = float32(math.Inf(-1))
+		} else {
+			isAnyAllowed = true
+		}
+	}
+	if !isAnyAllowed {
+		// regex can not continue with this vocabulary, end generation
+		logits[1] = 0
+	}
+}
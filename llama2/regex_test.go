@@ -0,0 +1,186 @@
+package llama2_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestRegexProcessor(t *testing.T) {
+	vocab := llama2.Vocab{Words: []string{"<unk>", "\n<s>\n", "\n</s>\n", "1", "2", "0", "-", "12", "2-", "-0", "a", "é", " 12", " -"}}
+	token := func(word string) int { return slices.Index(vocab.Words, word) }
+
+	re, err := llama2.CompileRegex(`\d{2}-\d{1,2}`, vocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		history []string
+		allowed []string
+	}{
+		{history: nil, allowed: []string{"1", "2", "0", "12"}},
+		{history: []string{"1"}, allowed: []string{"1", "2", "0", "2-"}},
+		{history: []string{"12"}, allowed: []string{"-", "-0"}},
+		{history: []string{"1", "2-"}, allowed: []string{"1", "2", "0", "12"}},
+		{history: []string{"12", "-0"}, allowed: []string{"1", "2", "0", "\n<s>\n"}},
+		{history: []string{"12", "-0", "1"}, allowed: []string{"\n<s>\n"}},
+	}
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.history, "|"), func(t *testing.T) {
+			p := llama2.NewRegexProcessor(re)
+
+			// prompt is not matched
+			history := []int{token("a"), token("é")}
+			logits := make([]float32, len(vocab.Words))
+			p.Process(history, logits)
+
+			for _, word := range tc.history {
+				history = append(history, token(word))
+			}
+			clear(logits)
+			p.Process(history, logits)
+
+			var allowed []string
+			for i, v := range logits {
+				if !math.IsInf(float64(v), -1) {
+					allowed = append(allowed, vocab.Words[i])
+				}
+			}
+			slices.Sort(allowed)
+			slices.Sort(tc.allowed)
+			if !slices.Equal(tc.allowed, allowed) {
+				t.Errorf("got %q, exp %q", allowed, tc.allowed)
+			}
+		})
+	}
+
+	t.Run("following BOS", func(t *testing.T) {
+		// sentencepiece decoder strips leading whitespace of token following BOS (1) token
+		p := llama2.NewRegexProcessor(re)
+		logits := make([]float32, len(vocab.Words))
+		p.Process(nil, logits)
+		if math.IsInf(float64(logits[token(" 12")]), -1) || !math.IsInf(float64(logits[token(" -")]), -1) {
+			t.Errorf("logits %v", logits)
+		}
+		clear(logits)
+		p.Process([]int{token(" 12")}, logits)
+		if math.IsInf(float64(logits[token("-")]), -1) || !math.IsInf(float64(logits[token(" 12")]), -1) {
+			t.Errorf("logits %v", logits)
+		}
+	})
+}
+
+func TestRegexNonASCII(t *testing.T) {
+	vocab := llama2.Vocab{Words: []string{"<unk>", "\n<s>\n", "\n</s>\n", "a", "k", "K", "\u212a", "é", "É", "ж", "Ж", "中"}}
+
+	tests := []struct {
+		expr    string
+		allowed []string
+	}{
+		{expr: `[é]`, allowed: []string{"é"}},
+		{expr: `[^aé]`, allowed: []string{"k", "K", "\u212a", "É", "ж", "Ж", "中"}},
+		{expr: `(?i)é`, allowed: []string{"é", "É"}},
+		{expr: `(?i)ж`, allowed: []string{"ж", "Ж"}},
+		{expr: `(?i)k`, allowed: []string{"k", "K", "\u212a"}},
+		{expr: `[\x{400}-\x{4FF}]`, allowed: []string{"ж", "Ж"}},
+		{expr: `.`, allowed: []string{"a", "k", "K", "\u212a", "é", "É", "ж", "Ж", "中"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.expr, func(t *testing.T) {
+			re, err := llama2.CompileRegex(tc.expr, vocab)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logits := make([]float32, len(vocab.Words))
+			llama2.NewRegexProcessor(re).Process([]int{3}, logits)
+
+			var allowed []string
+			for i, v := range logits {
+				if !math.IsInf(float64(v), -1) {
+					allowed = append(allowed, vocab.Words[i])
+				}
+			}
+			slices.Sort(allowed)
+			slices.Sort(tc.allowed)
+			if !slices.Equal(tc.allowed, allowed) {
+				t.Errorf("got %q, exp %q", allowed, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestRegexGenerate(t *testing.T) {
+	words := []string{"<unk>", "\n<s>\n", "\n</s>\n", "ab", "(5", "55", "-9", "é", "Ж", "<0xC3>", "<0xA9>", " .", " 5", " (", " cat", " id", "<0x20>"}
+	for c := ' '; c <= '~'; c++ {
+		words = append(words, string(c))
+	}
+	vocab := llama2.Vocab{Words: words}
+
+	config := testConfig
+	config.VocabSize = len(words)
+	w := newTestWeights(config, 1)
+
+	for _, expr := range []string{
+		`\d{4}-\d{2}-\d{2}`,
+		`\(\d{3}\) \d{3}-\d{4}`,
+		`(?i)id-[a-f0-9]{2,6}`,
+		`[^a-z]{1,8}\.`,
+		`(cat|dog|é+)( and (cat|dog))?`,
+		`^(cat|dog)$`,
+	} {
+		re, err := llama2.CompileRegex(expr, vocab)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := regexp.MustCompile(`^(?:` + expr + `)$`)
+
+		for seed := int64(0); seed < 10; seed++ {
+			t.Run(fmt.Sprintf("%s_%d", expr, seed), func(t *testing.T) {
+				s := llama2.NewRunState(config)
+				processors := llama2.LogitsProcessors{llama2.NewRegexProcessor(re)}
+				sampler := llama2.RandomSampler{Rand: rand.New(rand.NewSource(seed))}
+
+				var history []int
+				var out string
+				token := 1
+				for pos := 0; pos < config.SeqLen; pos++ {
+					llama2.Transformer(token, pos, config, s, w)
+					processors.Process(history, s.Logits)
+					prev := token
+					token = sampler.Sample(s.Logits)
+					if token == 1 {
+						break
+					}
+					history = append(history, token)
+					out += vocab.Decode(prev, token)
+				}
+				if !expected.MatchString(out) {
+					t.Errorf("%q does not match", out)
+				}
+			})
+		}
+	}
+}
+
+func TestCompileRegexError(t *testing.T) {
+	for _, expr := range []string{
+		`(ab`,
+		`a\b`,
+		`a$b`,
+		`x^y`,
+		`(^a)*`,
+		`[a-z]{1001}`,
+		`(a|b)*a(a|b){20}`,
+	} {
+		if _, err := llama2.CompileRegex(expr, llama2.Vocab{}); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
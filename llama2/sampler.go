@@ -0,0 +1,30 @@
+package llama2
+
+import (
+	"math/rand"
+
+	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
+)
+
+// Sampler picks next token from processed logits.
+type Sampler interface {
+	Sample(logits []float32) int
+}
+
+// GreedySampler picks the most likely token, deterministically.
+type GreedySampler struct{}
+
+func (GreedySampler) Sample(logits []float32) int { return nn.ArgMax(logits) }
+
+// RandomSampler samples token from probability distribution of logits.
+type RandomSampler struct {
+	Rand *rand.Rand // source of randomness (optional; default is global)
+}
+
+func (s RandomSampler) Sample(logits []float32) int {
+	nn.SoftMax(logits)
+	if s.Rand == nil {
+		return nn.Sample(logits)
+	}
+	return nn.SampleWith(logits, s.Rand.Float32())
+}
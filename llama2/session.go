@@ -0,0 +1,205 @@
+package llama2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"time"
+)
+
+// ErrContextFull is returned when prompt does not fit into context of model.
+var ErrContextFull = errors.New("prompt does not fit into context")
+
+// Token is generated token with its text.
+type Token struct {
+	ID   int
+	Text string
+}
+
+type GenerateOptions struct {
+	MaxTokens  int             // maximum number of generated tokens (0 = until context is full)
+	Processors LogitsProcessor // applied to logits before sampling (optional)
+	Sampler    Sampler         // picks next token (default GreedySampler)
+	Stop       []string        // generation stops before any of these texts, they are not written to Output
+	StopTokens []int           // generation stops at any of these tokens, they are not generated; BOS (1) token always stops
+	Output     io.Writer       // text of generated tokens (optional)
+	EchoPrompt bool            // write text of prompt to Output before generated text
+	// OnToken is called for each generated token, except the one that completes stop text (optional).
+	// Text of tokens before it, that starts stop text, is passed to OnToken but not written to Output.
+	// Returned error stops generation and is returned by Generate.
+	OnToken func(token Token) error
+}
+
+// GenerateStats describes one call of Generate.
+type GenerateStats struct {
+	PromptTokens int           // tokens of prompt
+	Tokens       int           // generated tokens
+	Duration     time.Duration // of forwarding prompt and generating tokens
+}
+
+// TokensPerSecond is rate of forwarded prompt and generated tokens.
+func (s GenerateStats) TokensPerSecond() float64 {
+	return float64(s.PromptTokens+s.Tokens) / s.Duration.Seconds()
+}
+
+// Session is conversation with model.
+// Each call to Generate continues context of the previous ones, where BOS (1) token is followed by prompts and generated tokens.
+// It keeps RunState, so it should be used by one goroutine at a time.
+// Sessions of the same model can run on many goroutines at once, since model is only read.
+type Session struct {
+	model  *Model
+	state  RunState
+	batch  *BatchRunState // for prompts, allocated by the first one
+	tokens []int          // context, first pos of them are in KV cache
+	pos    int
+}
+
+func NewSession(model *Model) *Session { return NewSessionWithState(model, NewRunState(model.Config)) }
+
+// NewSessionWithState is NewSession with state of model config, e.g. from RunStatePool, instead of new one.
+func NewSessionWithState(model *Model, state RunState) *Session {
+	s := &Session{model: model, state: state}
+	s.Reset()
+	return s
+}
+
+// State is RunState of session, e.g. to put it back to RunStatePool once session is done.
+func (s *Session) State() RunState { return s.state }
+
+// Reset clears context.
+func (s *Session) Reset() {
+	s.tokens = append(s.tokens[:0], 1) // 1 = BOS token in llama-2 sentencepiece
+	s.pos = 0
+}
+
+// Tokens of context, without BOS (1) token it starts with.
+func (s *Session) Tokens() []int { return s.tokens[1:] }
+
+// Generate appends prompt to context and generates continuation, until BOS (1) or stop token, stop text,
+// MaxTokens or full context.
+// Once ctx is done, generation stops before the next step or layer of model and error of ctx is returned.
+// Tokens generated before that stay in context.
+func (s *Session) Generate(ctx context.Context, prompt string, opts GenerateOptions) (stats GenerateStats, err error) {
+	config, vocab := s.model.Config, s.model.Vocab
+	timeStart := time.Now()
+	defer func() { stats.Duration = time.Since(timeStart) }()
+
+	promptTokens, err := vocab.encode(prompt)
+	if err != nil {
+		return stats, err
+	}
+	if len(s.tokens)+len(promptTokens) > config.SeqLen {
+		return stats, ErrContextFull
+	}
+	stats.PromptTokens = len(promptTokens)
+
+	sampler := opts.Sampler
+	if sampler == nil {
+		sampler = GreedySampler{}
+	}
+	output := opts.Output
+	if output == nil {
+		output = io.Discard
+	}
+	out := NewStopWriter(output, opts.Stop)
+
+	prev := s.tokens[len(s.tokens)-1]
+	for _, token := range promptTokens {
+		if opts.EchoPrompt {
+			if _, err := io.WriteString(output, vocab.Decode(prev, token)); err != nil {
+				return stats, err
+			}
+		}
+		prev = token
+	}
+	s.tokens = append(s.tokens, promptTokens...)
+	if opts.Processors != nil {
+		StartProcessor(opts.Processors, s.tokens[1:])
+	}
+
+	for opts.MaxTokens <= 0 || stats.Tokens < opts.MaxTokens {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		// forward tokens that are not in KV cache yet, the last one gives logits of the next token
+		if err := s.forward(ctx); err != nil {
+			return stats, err
+		}
+
+		if opts.Processors != nil {
+			opts.Processors.Process(s.tokens[1:], s.state.Logits)
+		}
+		next := sampler.Sample(s.state.Logits)
+
+		// data-dependent terminating condition: the BOS (1) token delimits sequences
+		// generated token has to fit into context, to be forwarded in the next step
+		if next == 1 || slices.Contains(opts.StopTokens, next) || len(s.tokens) == config.SeqLen {
+			break
+		}
+		s.tokens = append(s.tokens, next)
+		stats.Tokens++
+
+		token := Token{ID: next, Text: vocab.Decode(prev, next)}
+		prev = next
+		if _, err := out.WriteString(token.Text); err != nil {
+			return stats, err
+		}
+		// user-supplied stop string, possibly spanning multiple tokens
+		if out.Stopped() {
+			break
+		}
+		if opts.OnToken != nil {
+			if err := opts.OnToken(token); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, out.Flush()
+}
+
+// forward puts tokens into KV cache, prompt is forwarded in batches.
+func (s *Session) forward(ctx context.Context) error {
+	config := s.model.Config
+	if len(s.tokens)-s.pos == 1 {
+		if err := TransformerContext(ctx, s.tokens[s.pos], s.pos, config, s.state, s.model.Weights); err != nil {
+			return err
+		}
+		s.pos++
+		return nil
+	}
+	if s.batch == nil {
+		b := NewBatchRunState(config, min(prefillBatch, config.SeqLen))
+		s.batch = &b
+	}
+	if err := TransformerPrefill(ctx, s.tokens[s.pos:], s.pos, config, s.state, *s.batch, s.model.Weights); err != nil {
+		return err
+	}
+	s.pos = len(s.tokens)
+	return nil
+}
+
+// TokenSeq is iterator over generated tokens, same as iter.Seq2[Token, error].
+// Error is the last value it yields.
+type TokenSeq func(yield func(Token, error) bool)
+
+// errStopped is returned by OnToken when consumer of TokenSeq stops iteration.
+var errStopped = errors.New("stopped")
+
+// Stream is Generate that yields generated tokens instead of calling OnToken.
+// Tokens are generated by goroutine that iterates, so nothing is left running when iteration or ctx stops.
+// Text still goes to Output, when it is set.
+func (s *Session) Stream(ctx context.Context, prompt string, opts GenerateOptions) TokenSeq {
+	return func(yield func(Token, error) bool) {
+		opts.OnToken = func(token Token) error {
+			if !yield(token, nil) {
+				return errStopped
+			}
+			return nil
+		}
+		if _, err := s.Generate(ctx, prompt, opts); err != nil && err != errStopped {
+			yield(Token{}, err)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package llama2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+// newTestModel has vocabulary of control tokens, single letters and "ab".
+func newTestModel() *llama2.Model {
+	vocab := llama2.Vocab{Words: []string{"<unk>", "\n<s>\n", "\n</s>\n", "ab"}}
+	for c := 'a'; c <= 'z'; c++ {
+		vocab.Words = append(vocab.Words, string(c))
+	}
+	for c := 'A'; len(vocab.Words) < testConfig.VocabSize; c++ {
+		vocab.Words = append(vocab.Words, string(c))
+	}
+	vocab.Scores = make([]float32, len(vocab.Words))
+	return &llama2.Model{Config: testConfig, Weights: newTestWeights(testConfig, 1), Vocab: vocab}
+}
+
+func TestSessionGenerate(t *testing.T) {
+	m := newTestModel()
+	prompt := "abc"
+	promptTokens := m.Vocab.Encode(prompt)
+	expected := greedyDecode(m.Config, m.Weights, promptTokens, 20)
+
+	var out bytes.Buffer
+	var tokens []int
+	s := llama2.NewSession(m)
+	stats, err := s.Generate(context.Background(), prompt, llama2.GenerateOptions{
+		MaxTokens:  20,
+		Output:     &out,
+		EchoPrompt: true,
+		OnToken:    func(token llama2.Token) error { tokens = append(tokens, token.ID); return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(expected, tokens) {
+		t.Errorf("got %v, exp %v", tokens, expected)
+	}
+	if stats.PromptTokens != 2 || stats.Tokens != len(expected) {
+		t.Errorf("stats %+v", stats)
+	}
+	if text := prompt + decode(m.Vocab, promptTokens[len(promptTokens)-1], expected); out.String() != text {
+		t.Errorf("got %q, exp %q", out.String(), text)
+	}
+	if context := append(slices.Clone(promptTokens), expected...); !slices.Equal(context, s.Tokens()) {
+		t.Errorf("context %v, exp %v", s.Tokens(), context)
+	}
+
+	// generation continues context
+	stats, err = s.Generate(context.Background(), "z", llama2.GenerateOptions{MaxTokens: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := append(append(slices.Clone(promptTokens), expected...), m.Vocab.Encode("z")...)
+	expected = greedyDecode(m.Config, m.Weights, context, 10)
+	if context := append(context, expected...); !slices.Equal(context, s.Tokens()) {
+		t.Errorf("context %v, exp %v", s.Tokens(), context)
+	}
+
+	s.Reset()
+	if len(s.Tokens()) != 0 {
+		t.Errorf("context %v after reset", s.Tokens())
+	}
+}
+
+func decode(vocab llama2.Vocab, prev int, tokens []int) (text string) {
+	for _, token := range tokens {
+		text += vocab.Decode(prev, token)
+		prev = token
+	}
+	return text
+}
+
+func TestSessionGenerateStop(t *testing.T) {
+	m := newTestModel()
+	expected := greedyDecode(m.Config, m.Weights, nil, 20)
+	text := decode(m.Vocab, 1, expected)
+
+	t.Run("max tokens", func(t *testing.T) {
+		var out strings.Builder
+		stats, err := llama2.NewSession(m).Generate(context.Background(), "", llama2.GenerateOptions{MaxTokens: 3, Output: &out})
+		if err != nil || stats.Tokens != 3 || out.String() != decode(m.Vocab, 1, expected[:3]) {
+			t.Errorf("got %q %+v %v", out.String(), stats, err)
+		}
+	})
+
+	t.Run("stop text", func(t *testing.T) {
+		var out strings.Builder
+		stop := text[5:7]
+		_, err := llama2.NewSession(m).Generate(context.Background(), "", llama2.GenerateOptions{MaxTokens: 20, Output: &out, Stop: []string{stop}})
+		if err != nil || out.String() != text[:strings.Index(text, stop)] {
+			t.Errorf("got %q %v", out.String(), err)
+		}
+	})
+
+	t.Run("stop token", func(t *testing.T) {
+		stats, err := llama2.NewSession(m).Generate(context.Background(), "", llama2.GenerateOptions{MaxTokens: 20, StopTokens: []int{expected[4]}})
+		if err != nil || stats.Tokens != slices.Index(expected, expected[4]) {
+			t.Errorf("got %+v %v", stats, err)
+		}
+	})
+
+	t.Run("callback error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		stats, err := llama2.NewSession(m).Generate(context.Background(), "", llama2.GenerateOptions{OnToken: func(llama2.Token) error { return errStop }})
+		if err != errStop || stats.Tokens != 1 {
+			t.Errorf("got %+v %v", stats, err)
+		}
+	})
+
+	t.Run("bad prompt", func(t *testing.T) {
+		if _, err := llama2.NewSession(m).Generate(context.Background(), "?", llama2.GenerateOptions{}); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("context full", func(t *testing.T) {
+		if _, err := llama2.NewSession(m).Generate(context.Background(), strings.Repeat("z", m.Config.SeqLen), llama2.GenerateOptions{}); err != llama2.ErrContextFull {
+			t.Errorf("got %v", err)
+		}
+		stats, err := llama2.NewSession(m).Generate(context.Background(), strings.Repeat("z", m.Config.SeqLen-10), llama2.GenerateOptions{})
+		if err != nil || stats.Tokens > 9 {
+			t.Errorf("got %+v %v", stats, err)
+		}
+	})
+}
+
+func TestSessionGenerateAllocs(t *testing.T) {
+	m := newTestModel()
+	s := llama2.NewSession(m)
+	opts := llama2.GenerateOptions{
+		Processors: llama2.LogitsProcessors{llama2.LogitBias{1: float32(math.Inf(-1))}, llama2.NewNGramBlocker(3)},
+		Output:     io.Discard,
+	}
+	generate := func(n int) func() {
+		return func() {
+			s.Reset()
+			opts.MaxTokens = n
+			if stats, err := s.Generate(context.Background(), "ab", opts); err != nil || stats.Tokens != n {
+				t.Fatal(stats, err)
+			}
+		}
+	}
+
+	// warm up reusable buffers
+	generate(50)()
+
+	// allocations are per call, not per generated token
+	if one, many := testing.AllocsPerRun(10, generate(1)), testing.AllocsPerRun(10, generate(50)); many != one {
+		t.Errorf("%f allocations for 50 tokens, %f for one", many, one)
+	}
+}
+
+func TestNewModelTruncated(t *testing.T) {
+	var checkpoint bytes.Buffer
+	for _, v := range []int32{16, 32, 2, 4, 2, 64, 128} {
+		checkpoint.Write([]byte{byte(v), 0, 0, 0})
+	}
+	checkpoint.Write(make([]byte, 1000))
+	if _, err := llama2.NewModel(&checkpoint, strings.NewReader("")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestModelSetThreads(t *testing.T) {
+	m := newTestModel()
+	expected := greedyDecode(m.Config, m.Weights, nil, 20)
+	for _, threads := range []int{1, 3} {
+		m.SetThreads(threads)
+		if got := greedyDecode(m.Config, m.Weights, nil, 20); !slices.Equal(expected, got) {
+			t.Errorf("threads %d: got %v, exp %v", threads, got, expected)
+		}
+	}
+	m.Weights.Pool.Close()
+
+	t.Run("at least one", func(t *testing.T) {
+		m := newTestModel()
+		m.SetThreads(-1)
+		defer m.Weights.Pool.Close()
+		if size := m.Weights.Pool.Size(); size != 1 {
+			t.Errorf("size %d", size)
+		}
+		if got := greedyDecode(m.Config, m.Weights, nil, 20); !slices.Equal(expected, got) {
+			t.Errorf("got %v, exp %v", got, expected)
+		}
+	})
+
+	t.Run("pool set by caller is not closed", func(t *testing.T) {
+		owner := newTestModel()
+		owner.SetThreads(2)
+		defer owner.Weights.Pool.Close()
+		pool := owner.Weights.Pool
+
+		m := newTestModel()
+		m.Weights.Pool = pool
+		m.SetThreads(2)
+		defer m.Weights.Pool.Close()
+
+		// pool is shared with draft model, as in main
+		draft := newTestModel()
+		draft.Weights.Pool = pool
+		if got := greedyDecode(draft.Config, draft.Weights, nil, 20); !slices.Equal(expected, got) {
+			t.Errorf("got %v, exp %v", got, expected)
+		}
+	})
+}
+
+func TestSessionSaveLoad(t *testing.T) {
+	m := newTestModel()
+	expected := greedyDecode(m.Config, m.Weights, m.Vocab.Encode("abc"), 10)
+
+	for _, opts := range []llama2.GenerateOptions{
+		{MaxTokens: 10},
+		{StopTokens: []int{expected[5]}}, // all tokens are in KV cache when generation stops at stop token
+	} {
+		s := llama2.NewSession(m)
+		if _, err := s.Generate(context.Background(), "abc", opts); err != nil {
+			t.Fatal(err)
+		}
+		var file bytes.Buffer
+		if err := s.Save(&file); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := llama2.NewSession(m)
+		if err := restored.Load(bytes.NewReader(file.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(s.Tokens(), restored.Tokens()) {
+			t.Errorf("got %v, exp %v", restored.Tokens(), s.Tokens())
+		}
+
+		for _, s := range []*llama2.Session{s, restored} {
+			if _, err := s.Generate(context.Background(), "z", llama2.GenerateOptions{MaxTokens: 10}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !slices.Equal(s.Tokens(), restored.Tokens()) {
+			t.Errorf("continuation %v, exp %v", restored.Tokens(), s.Tokens())
+		}
+	}
+
+	s := llama2.NewSession(m)
+	if _, err := s.Generate(context.Background(), "abc", llama2.GenerateOptions{MaxTokens: 10}); err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	if err := s.Save(&file); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("other weights", func(t *testing.T) {
+		other := newTestModel()
+		other.Weights = newTestWeights(other.Config, 2)
+		if err := llama2.NewSession(other).Load(bytes.NewReader(file.Bytes())); err != llama2.ErrModelMismatch {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("other config", func(t *testing.T) {
+		other := newTestModel()
+		other.Config.SeqLen = 64
+		if err := llama2.NewSession(other).Load(bytes.NewReader(file.Bytes())); err != llama2.ErrModelMismatch {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		restored := llama2.NewSession(m)
+		if _, err := restored.Generate(context.Background(), "x", llama2.GenerateOptions{MaxTokens: 1}); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{0, 10, file.Len() - 1} {
+			if err := restored.Load(bytes.NewReader(file.Bytes()[:n])); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%d bytes: got %v", n, err)
+			}
+			if len(restored.Tokens()) != 0 {
+				t.Errorf("%d bytes: session is not reset %v", n, restored.Tokens())
+			}
+		}
+	})
+}
+
+// TestConcurrentSessions is meant to run with -race, sessions share model and worker pool.
+func TestConcurrentSessions(t *testing.T) {
+	m := newTestModel()
+	m.SetThreads(4)
+	defer m.Weights.Pool.Close()
+	prompts := []string{"", "abc", "hello", "z", "xyz", "abab", "q", "once"}
+	generate := func(s *llama2.Session, i int) []int {
+		_, err := s.Generate(context.Background(), prompts[i], llama2.GenerateOptions{
+			MaxTokens:  30,
+			Processors: llama2.LogitsProcessors{&llama2.Penalties{Window: 16, Repetition: 1.2}, llama2.Temperature(0.8), llama2.TopK(10)},
+			Sampler:    llama2.RandomSampler{Rand: rand.New(rand.NewSource(int64(i)))},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return slices.Clone(s.Tokens())
+	}
+
+	expected := make([][]int, len(prompts))
+	for i := range prompts {
+		expected[i] = generate(llama2.NewSession(m), i)
+	}
+
+	// fewer states than sessions, so that some sessions wait for others and reuse their states
+	states, err := llama2.NewRunStatePool(m.Config, 3*m.Config.RunStateBytes()+1)
+	if err != nil || states.Size() != 3 {
+		t.Fatal(states, err)
+	}
+
+	got := make([][]int, len(prompts))
+	var wg sync.WaitGroup
+	for i := range prompts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			state, err := states.Get(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer states.Put(state)
+			got[i] = generate(llama2.NewSessionWithState(m, state), i)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range prompts {
+		if !slices.Equal(expected[i], got[i]) {
+			t.Errorf("prompt %q: got %v, exp %v", prompts[i], got[i], expected[i])
+		}
+	}
+}
+
+func TestRunStatePool(t *testing.T) {
+	config := testConfig
+	if _, err := llama2.NewRunStatePool(config, config.RunStateBytes()-1); err == nil {
+		t.Error("expected error")
+	}
+
+	states, err := llama2.NewRunStatePool(config, config.RunStateBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := states.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all states are taken
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := states.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v", err)
+	}
+
+	states.Put(s)
+	if s2, err := states.Get(context.Background()); err != nil || &s2.KCache[0] != &s.KCache[0] {
+		t.Errorf("state is not reused: %v", err)
+	}
+}
+
+func TestSessionGenerateContext(t *testing.T) {
+	m := newTestModel()
+	expected := greedyDecode(m.Config, m.Weights, nil, 20)
+	goroutines := runtime.NumGoroutine()
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := llama2.NewSession(m)
+		stats, err := s.Generate(ctx, "", llama2.GenerateOptions{
+			MaxTokens: 20,
+			OnToken: func(token llama2.Token) error {
+				if token.ID == expected[2] {
+					cancel()
+				}
+				return nil
+			},
+		})
+		if !errors.Is(err, context.Canceled) || stats.Tokens != 3 {
+			t.Errorf("got %+v %v", stats, err)
+		}
+
+		// session continues after cancellation
+		if _, err := s.Generate(context.Background(), "", llama2.GenerateOptions{MaxTokens: 17}); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(expected, s.Tokens()) {
+			t.Errorf("got %v, exp %v", s.Tokens(), expected)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+		defer cancel()
+		stats, err := llama2.NewSession(m).Generate(ctx, "", llama2.GenerateOptions{})
+		if !errors.Is(err, context.DeadlineExceeded) || stats.Tokens != 0 {
+			t.Errorf("got %+v %v", stats, err)
+		}
+	})
+
+	t.Run("layer", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := llama2.TransformerContext(ctx, 1, 0, m.Config, llama2.NewRunState(m.Config), m.Weights); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var tokens []int
+		llama2.NewSession(m).Stream(context.Background(), "", llama2.GenerateOptions{MaxTokens: 20})(func(token llama2.Token, err error) bool {
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, token.ID)
+			return len(tokens) < 5
+		})
+		if !slices.Equal(expected[:5], tokens) {
+			t.Errorf("got %v, exp %v", tokens, expected[:5])
+		}
+	})
+
+	t.Run("stream stop", func(t *testing.T) {
+		// token that completes stop text is not yielded
+		text := decode(m.Vocab, 1, expected)
+		stop := decode(m.Vocab, expected[2], expected[3:5])
+		end := strings.Index(text, stop) + len(stop)
+		completing := 0
+		for len(decode(m.Vocab, 1, expected[:completing+1])) < end {
+			completing++
+		}
+
+		var tokens []int
+		var out strings.Builder
+		llama2.NewSession(m).Stream(context.Background(), "", llama2.GenerateOptions{MaxTokens: 20, Stop: []string{stop}, Output: &out})(func(token llama2.Token, err error) bool {
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, token.ID)
+			return true
+		})
+		if !slices.Equal(expected[:completing], tokens) {
+			t.Errorf("got %v, exp %v", tokens, expected[:completing])
+		}
+		if exp := text[:strings.Index(text, stop)]; out.String() != exp {
+			t.Errorf("got %q, exp %q", out.String(), exp)
+		}
+	})
+
+	t.Run("stream cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var tokens []int
+		var errs []error
+		llama2.NewSession(m).Stream(ctx, "", llama2.GenerateOptions{MaxTokens: 20})(func(token llama2.Token, err error) bool {
+			if err != nil {
+				errs = append(errs, err)
+				return false
+			}
+			if tokens = append(tokens, token.ID); len(tokens) == 5 {
+				cancel()
+			}
+			return true
+		})
+		if len(tokens) != 5 || len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+			t.Errorf("got %v %v", tokens, errs)
+		}
+	})
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("goroutines %d, before %d", n, goroutines)
+	}
+}
@@ -0,0 +1,148 @@
+package llama2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+// ErrModelMismatch is returned when session is restored into model other than one it was saved from.
+var ErrModelMismatch = errors.New("session is of different model")
+
+var sessionMagic = [4]byte{'l', 'g', 's', 'n'}
+
+const sessionVersion = 1
+
+// sessionHeader is followed by tokens and then by keys and values of each layer for positions before Pos.
+type sessionHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	Fingerprint uint64
+	Pos         int32
+	NumTokens   int32
+}
+
+// fingerprintSamples is number of evenly spaced values of each weight matrix that go into fingerprint.
+const fingerprintSamples = 1024
+
+// Fingerprint identifies model by its config, vocabulary and samples of weights,
+// reading all weights of large model would take as long as loading it.
+func (m *Model) Fingerprint() uint64 {
+	h := fnv.New64a()
+	for _, v := range []int{m.Config.Dim, m.Config.HiddenDim, m.Config.NumLayers, m.Config.NumHeads, m.Config.NumKVHeads, m.Config.VocabSize, m.Config.SeqLen} {
+		binary.Write(h, Endian, int64(v))
+	}
+	for i, word := range m.Vocab.Words {
+		io.WriteString(h, word)
+		binary.Write(h, Endian, m.Vocab.Scores[i])
+	}
+
+	w := m.Weights
+	var buf [8]byte
+	for _, x := range [][]float32{w.TokenEmbeddingTable, w.RMSAttentionWeight, w.RMSFFNWeight, w.RMSFinalWeight, w.WQ, w.WK, w.WV, w.WO, w.W1, w.W2, w.W3, w.WCLS} {
+		Endian.PutUint64(buf[:], uint64(len(x)))
+		h.Write(buf[:])
+		step := max(len(x)/fingerprintSamples, 1)
+		for i := 0; i < len(x); i += step {
+			Endian.PutUint32(buf[:4], math.Float32bits(x[i]))
+			h.Write(buf[:4])
+		}
+	}
+	return h.Sum64()
+}
+
+// Save writes context of session and its KV cache to w, so that Load can continue it later
+// without forwarding it again, e.g. to reuse long system prompt.
+func (s *Session) Save(w io.Writer) error {
+	header := sessionHeader{
+		Magic:       sessionMagic,
+		Version:     sessionVersion,
+		Fingerprint: s.model.Fingerprint(),
+		Pos:         int32(s.pos),
+		NumTokens:   int32(len(s.tokens)),
+	}
+	if err := binary.Write(w, Endian, header); err != nil {
+		return err
+	}
+
+	tokens := make([]int32, len(s.tokens))
+	for i, token := range s.tokens {
+		tokens[i] = int32(token)
+	}
+	if err := binary.Write(w, Endian, tokens); err != nil {
+		return err
+	}
+
+	config := s.model.Config
+	kvDim := config.KVDim()
+	for l := 0; l < config.NumLayers; l++ {
+		loff := l * config.SeqLen * kvDim
+		if err := binary.Write(w, Endian, s.state.KCache[loff:loff+s.pos*kvDim]); err != nil {
+			return err
+		}
+		if err := binary.Write(w, Endian, s.state.VCache[loff:loff+s.pos*kvDim]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load replaces context of session with one written by Save.
+// It returns ErrModelMismatch when session was saved with other model.
+// Session is reset when Load fails.
+func (s *Session) Load(r io.Reader) (err error) {
+	defer func() {
+		if err != nil {
+			s.Reset()
+		}
+	}()
+	config := s.model.Config
+	kvDim := config.KVDim()
+	er := &errReader{r: r}
+
+	var header sessionHeader
+	if err := binary.Read(er, Endian, &header); err != nil {
+		return fmt.Errorf("cannot read session: %w", err)
+	}
+	if header.Magic != sessionMagic || header.Version != sessionVersion {
+		return errors.New("not a session file")
+	}
+	if header.Fingerprint != s.model.Fingerprint() {
+		return ErrModelMismatch
+	}
+	pos, n := int(header.Pos), int(header.NumTokens)
+	if n < 1 || n > config.SeqLen || pos < 0 || pos > n {
+		return fmt.Errorf("session has %d tokens at position %d, context is %d", n, pos, config.SeqLen)
+	}
+
+	tokens := make([]int32, n)
+	if err := binary.Read(er, Endian, tokens); err != nil {
+		return fmt.Errorf("cannot read session: %w", err)
+	}
+	for _, token := range tokens {
+		if token < 0 || int(token) >= config.VocabSize {
+			return fmt.Errorf("session has token %d out of vocabulary", token)
+		}
+	}
+
+	for l := 0; l < config.NumLayers; l++ {
+		loff := l * config.SeqLen * kvDim
+		if err := binary.Read(er, Endian, s.state.KCache[loff:loff+pos*kvDim]); err != nil {
+			return fmt.Errorf("cannot read session: %w", err)
+		}
+		if err := binary.Read(er, Endian, s.state.VCache[loff:loff+pos*kvDim]); err != nil {
+			return fmt.Errorf("cannot read session: %w", err)
+		}
+	}
+
+	s.tokens = s.tokens[:0]
+	for _, token := range tokens {
+		s.tokens = append(s.tokens, int(token))
+	}
+	// logits are not saved, so the last token is forwarded again to get them
+	s.pos = min(pos, n-1)
+	return nil
+}
@@ -0,0 +1,252 @@
+package llama2
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"slices"
+
+	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
+)
+
+type SpeculativeOptions struct {
+	DraftTokens int  // number of tokens draft model proposes for each pass of target model
+	MaxTokens   int  // maximum number of generated tokens
+	Greedy      bool // pick the most likely tokens, otherwise sample
+	// Processors are applied to logits of both models at every position, given history with drafted tokens.
+	// They should depend only on given history, like Temperature, Truncation, Penalties and LogitBias,
+	// since history is rolled back when drafted tokens are rejected.
+	Processors LogitsProcessor
+	Rand       *rand.Rand // source of randomness (optional; default is global)
+	NGram      int        // prompt lookup matches up to this many last tokens against earlier text (default 3)
+}
+
+// SpeculativeStats counts work done by speculative decoding.
+type SpeculativeStats struct {
+	Generated    int // tokens generated
+	Drafted      int // tokens proposed by draft model
+	Accepted     int // drafted tokens accepted by target model
+	TargetPasses int // forward passes of target model, each for batch of tokens
+}
+
+// SpeculativeDecode generates continuation of prompt with target model, while smaller draft model with same vocabulary
+// proposes DraftTokens tokens at a time that target model checks in one batched pass.
+// Drafted tokens are accepted by rejection sampling, so that generated tokens are distributed as if sampled from target model alone;
+// on rejection token is sampled from normalized max(0, p - q), where p and q are distributions of target and draft models.
+// Keys and values of rejected positions stay in KV caches and are overwritten later, since attention reads only positions before current one.
+// Accepted tokens and token sampled after them are passed to emit in order, several per pass of target model;
+// returning false stops decoding at that token. BOS (1) token ends decoding without being emitted.
+// Prompt that does not fit into context of both models is ErrContextFull.
+func SpeculativeDecode(config Config, w TransformerWeights, draftConfig Config, draftW TransformerWeights, prompt []int, opts SpeculativeOptions, emit func(token int) bool) (SpeculativeStats, error) {
+	if config.VocabSize != draftConfig.VocabSize {
+		return SpeculativeStats{}, errors.New("draft model has different vocabulary size")
+	}
+	d := &modelDrafter{config: draftConfig, w: draftW, s: NewRunState(draftConfig)}
+	return speculate(config, w, min(config.SeqLen, draftConfig.SeqLen), prompt, opts, d, emit)
+}
+
+// PromptLookupDecode is speculative decoding without draft model.
+// Tokens that followed earlier occurrence of the last NGram tokens in prompt or generated text are proposed as draft,
+// which often is right when output copies input, e.g. in summarization or editing.
+// Drafted tokens are accepted by the same rejection sampling, so generated tokens are distributed as if sampled from model alone.
+func PromptLookupDecode(config Config, w TransformerWeights, prompt []int, opts SpeculativeOptions, emit func(token int) bool) (SpeculativeStats, error) {
+	d := promptLookupDrafter{ngram: opts.NGram, vocabSize: config.VocabSize}
+	if d.ngram <= 0 {
+		d.ngram = 3
+	}
+	return speculate(config, w, config.SeqLen, prompt, opts, d, emit)
+}
+
+// drafter proposes tokens for speculative decoding.
+type drafter interface {
+	// draft appends up to n tokens that follow history ending with token at pos,
+	// row i of q is distribution drafted token i was sampled from.
+	draft(history []int, token, pos, n int, drafts []int, q []float32, sampler *speculativeSampler) []int
+	// accept tells that tokens are in sequence at positions from pos.
+	accept(tokens []int, pos int)
+}
+
+// modelDrafter samples tokens from smaller model.
+type modelDrafter struct {
+	config    Config
+	w         TransformerWeights
+	s         RunState
+	forwarded int // number of positions in KV cache that are in sequence or drafted
+}
+
+func (d *modelDrafter) draft(history []int, token, pos, n int, drafts []int, q []float32, sampler *speculativeSampler) []int {
+	vocabSize := d.config.VocabSize
+	for i, t := 0, token; i < n; i++ {
+		Transformer(t, pos+i, d.config, d.s, d.w)
+		qi := q[i*vocabSize : (i+1)*vocabSize]
+		copy(qi, d.s.Logits)
+		sampler.process(append(history, drafts...), qi)
+		t = sampler.pick(qi)
+		drafts = append(drafts, t)
+		if t == 1 {
+			break
+		}
+	}
+	d.forwarded = pos + len(drafts)
+	return drafts
+}
+
+func (d *modelDrafter) accept(tokens []int, pos int) {
+	// forward accepted tokens that are not in KV cache yet, e.g. the last drafted one
+	for i := max(d.forwarded-pos, 0); i < len(tokens); i++ {
+		Transformer(tokens[i], pos+i, d.config, d.s, d.w)
+	}
+	d.forwarded = pos + len(tokens)
+}
+
+// promptLookupDrafter copies tokens that followed the most recent earlier occurrence of the longest matching suffix of history.
+type promptLookupDrafter struct {
+	ngram     int
+	vocabSize int
+}
+
+func (d promptLookupDrafter) draft(history []int, token, pos, n int, drafts []int, q []float32, sampler *speculativeSampler) []int {
+	for size := min(d.ngram, len(history)-1); size > 0 && len(drafts) == 0; size-- {
+		suffix := history[len(history)-size:]
+		for start := len(history) - size - 1; start >= 0; start-- {
+			if slices.Equal(history[start:start+size], suffix) {
+				end := min(start+size+n, len(history))
+				drafts = append(drafts, history[start+size:end]...)
+				break
+			}
+		}
+	}
+
+	// drafted tokens are certain
+	for i, t := range drafts {
+		qi := q[i*d.vocabSize : (i+1)*d.vocabSize]
+		clear(qi)
+		qi[t] = 1
+	}
+	return drafts
+}
+
+func (promptLookupDrafter) accept(tokens []int, pos int) {}
+
+// speculativeSampler turns logits into distributions and picks tokens from them.
+type speculativeSampler struct {
+	opts SpeculativeOptions
+}
+
+func (s *speculativeSampler) random() float32 {
+	if s.opts.Rand == nil {
+		return rand.Float32()
+	}
+	return s.opts.Rand.Float32()
+}
+
+func (s *speculativeSampler) process(history []int, logits []float32) {
+	if s.opts.Processors != nil {
+		s.opts.Processors.Process(history, logits)
+	}
+	if !s.opts.Greedy {
+		nn.SoftMax(logits)
+	}
+}
+
+func (s *speculativeSampler) pick(p []float32) int {
+	if s.opts.Greedy {
+		return nn.ArgMax(p)
+	}
+	return nn.SampleWith(p, s.random())
+}
+
+// speculate verifies tokens proposed by drafter with target model.
+func speculate(config Config, w TransformerWeights, seqLen int, prompt []int, opts SpeculativeOptions, d drafter, emit func(token int) bool) (SpeculativeStats, error) {
+	var stats SpeculativeStats
+	k := max(opts.DraftTokens, 0)
+	vocabSize := config.VocabSize
+	sampler := &speculativeSampler{opts: opts}
+
+	s := NewRunState(config)
+	b := NewBatchRunState(config, k+1)
+
+	// BOS (1) token and prompt, except last token that is forwarded in the first round
+	tokens := append([]int{1}, prompt...)
+	if len(tokens) > seqLen {
+		return stats, ErrContextFull
+	}
+	pos := len(tokens) - 1
+	for i := 0; i < pos; i += k + 1 {
+		transformerBatch(context.Background(), tokens[i:min(i+k+1, pos)], batchPositions{s: s, pos: i}, config, b, w, nil)
+	}
+	d.accept(tokens[:pos], 0)
+	token := tokens[pos]
+	history := append(make([]int, 0, len(prompt)+opts.MaxTokens+k+1), tokens[1:]...)
+
+	// distributions of drafted tokens
+	q := make([]float32, k*vocabSize)
+	residual := make([]float32, vocabSize)
+	drafts := make([]int, 0, k)
+	batch := make([]int, 0, k+1)
+
+	for stats.Generated < opts.MaxTokens && pos < seqLen {
+		// draft as many tokens as there is room for
+		n := min(k, opts.MaxTokens-stats.Generated-1, seqLen-pos-1)
+		drafts = d.draft(history, token, pos, n, drafts[:0], q, sampler)
+		stats.Drafted += len(drafts)
+
+		// check all drafted tokens with target model in one pass, row i is distribution after i drafted tokens
+		TransformerBatch(append(append(batch[:0], token), drafts...), pos, config, s, b, w)
+		stats.TargetPasses++
+
+		accepted := 0
+		next := -1
+		for i, drafted := range drafts {
+			p := b.Logits[i*vocabSize : (i+1)*vocabSize]
+			sampler.process(append(history, drafts[:i]...), p)
+			qi := q[i*vocabSize : (i+1)*vocabSize]
+
+			if opts.Greedy {
+				if best := nn.ArgMax(p); best != drafted {
+					next = best
+					break
+				}
+			} else if p[drafted] < qi[drafted] && sampler.random()*qi[drafted] >= p[drafted] {
+				// rejected with probability 1 - p/q, sample from what target model has more than draft
+				var sum float32
+				for j := range residual {
+					residual[j] = max(p[j]-qi[j], 0)
+					sum += residual[j]
+				}
+				if sum == 0 {
+					copy(residual, p)
+				} else {
+					for j := range residual {
+						residual[j] /= sum
+					}
+				}
+				next = nn.SampleWith(residual, sampler.random())
+				break
+			}
+			accepted++
+		}
+		stats.Accepted += accepted
+		if next < 0 {
+			// all drafted tokens are accepted, target model gives one more token for free
+			p := b.Logits[accepted*vocabSize : (accepted+1)*vocabSize]
+			sampler.process(append(history, drafts...), p)
+			next = sampler.pick(p)
+		}
+		d.accept(append(append(batch[:0], token), drafts[:accepted]...), pos)
+
+		for _, t := range append(drafts[:accepted], next) {
+			if t == 1 || stats.Generated == opts.MaxTokens {
+				return stats, nil
+			}
+			history = append(history, t)
+			stats.Generated++
+			if !emit(t) {
+				return stats, nil
+			}
+		}
+		pos += accepted + 1
+		token = next
+	}
+	return stats, nil
+}
@@ -0,0 +1,203 @@
+package llama2_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestSpeculativeDecodeGreedy(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	prompt := []int{5, 17, 3}
+
+	expected := greedyDecode(testConfig, w, prompt, 40)
+
+	for _, draftSeed := range []int64{1, 2} {
+		for _, k := range []int{0, 1, 4} {
+			t.Run(fmt.Sprintf("draft_%d_k_%d", draftSeed, k), func(t *testing.T) {
+				var tokens []int
+				stats, err := llama2.SpeculativeDecode(testConfig, w, testConfig, newTestWeights(testConfig, draftSeed), prompt, llama2.SpeculativeOptions{
+					DraftTokens: k,
+					MaxTokens:   40,
+					Greedy:      true,
+				}, func(token int) bool { tokens = append(tokens, token); return true })
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(expected, tokens) {
+					t.Errorf("got %v, exp %v", tokens, expected)
+				}
+				if stats.Generated != len(tokens) {
+					t.Errorf("generated %d, exp %d", stats.Generated, len(tokens))
+				}
+				// draft model same as target proposes only accepted tokens
+				if draftSeed == 1 && stats.Accepted != stats.Drafted {
+					t.Errorf("accepted %d of %d", stats.Accepted, stats.Drafted)
+				}
+			})
+		}
+	}
+}
+
+// greedyDecode is plain greedy decoding of up to n tokens.
+func greedyDecode(config llama2.Config, w llama2.TransformerWeights, prompt []int, n int) (generated []int) {
+	s := llama2.NewRunState(config)
+	tokens := append([]int{1}, prompt...)
+	token := 1
+	for pos := 0; pos < n+len(prompt); pos++ {
+		llama2.Transformer(token, pos, config, s, w)
+		if pos+1 < len(tokens) {
+			token = tokens[pos+1]
+			continue
+		}
+		if token = (llama2.GreedySampler{}).Sample(s.Logits); token == 1 {
+			break
+		}
+		generated = append(generated, token)
+	}
+	return generated
+}
+
+func TestPromptLookupDecodeGreedy(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+
+	// greedy decoding of random model soon repeats itself, so that lookup finds continuations
+	for _, prompt := range [][]int{nil, {5, 17, 3, 5, 17}, greedyDecode(testConfig, w, []int{7}, 20)} {
+		expected := greedyDecode(testConfig, w, prompt, 40)
+		for _, ngram := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%v_ngram_%d", prompt, ngram), func(t *testing.T) {
+				var tokens []int
+				stats, err := llama2.PromptLookupDecode(testConfig, w, prompt, llama2.SpeculativeOptions{
+					DraftTokens: 4,
+					MaxTokens:   40,
+					Greedy:      true,
+					NGram:       ngram,
+				}, func(token int) bool { tokens = append(tokens, token); return true })
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(expected, tokens) {
+					t.Errorf("got %v, exp %v", tokens, expected)
+				}
+				if len(prompt) > 0 && stats.Accepted == 0 {
+					t.Errorf("no drafted tokens accepted: %+v", stats)
+				}
+			})
+		}
+	}
+}
+
+func TestSpeculativeDecodeDistribution(t *testing.T) {
+	config := testConfig
+	config.VocabSize = 8
+	w := newTestWeights(config, 1)
+	draftW := newTestWeights(config, 2)
+	prompt := []int{5, 3, 5}
+	opts := llama2.SpeculativeOptions{DraftTokens: 2, MaxTokens: 2, Processors: llama2.Temperature(0.5), NGram: 1}
+
+	// distributions of the first generated token, and of the second one after the most likely first one, of target model alone
+	s := llama2.NewRunState(config)
+	distribution := func() []float32 {
+		p := slices.Clone(s.Logits)
+		llama2.Temperature(0.5).Process(nil, p)
+		softMax(p)
+		return p
+	}
+	for pos, token := range append([]int{1}, prompt...) {
+		llama2.Transformer(token, pos, config, s, w)
+	}
+	expectedFirst := distribution()
+	first := slices.Index(expectedFirst, slices.Max(expectedFirst))
+	llama2.Transformer(first, len(prompt)+1, config, s, w)
+	expected := distribution()
+
+	tests := map[string]func(opts llama2.SpeculativeOptions, emit func(token int) bool){
+		"draft": func(opts llama2.SpeculativeOptions, emit func(token int) bool) {
+			llama2.SpeculativeDecode(config, w, config, draftW, prompt, opts, emit)
+		},
+		"prompt_lookup": func(opts llama2.SpeculativeOptions, emit func(token int) bool) {
+			llama2.PromptLookupDecode(config, w, prompt, opts, emit)
+		},
+	}
+	for name, decode := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts.Rand = rand.New(rand.NewSource(1))
+			counts := make([]float64, config.VocabSize)
+			countsFirst := make([]float64, config.VocabSize)
+			var total float64
+			for i := 0; i < 10000; i++ {
+				var tokens []int
+				decode(opts, func(token int) bool { tokens = append(tokens, token); return true })
+				// BOS (1) token ends generation and is not emitted
+				tokens = append(tokens, 1)
+				countsFirst[tokens[0]]++
+				if tokens[0] == first {
+					counts[tokens[1]]++
+					total++
+				}
+			}
+			if total < 500 {
+				t.Fatalf("too few samples %f", total)
+			}
+
+			if tv := totalVariation(countsFirst, expectedFirst); tv > 0.02 {
+				t.Errorf("first token distance %f, got %v, exp %v", tv, countsFirst, expectedFirst)
+			}
+			if tv := totalVariation(counts, expected); tv > 0.02 {
+				t.Errorf("second token distance %f, got %v, exp %v", tv, counts, expected)
+			}
+		})
+	}
+}
+
+func totalVariation(counts []float64, p []float32) (tv float64) {
+	var total float64
+	for _, c := range counts {
+		total += c
+	}
+	for i := range counts {
+		tv += math.Abs(counts[i]/total-float64(p[i])) / 2
+	}
+	return tv
+}
+
+func softMax(x []float32) {
+	maxVal := slices.Max(x)
+	var sum float32
+	for i := range x {
+		x[i] = float32(math.Exp(float64(x[i] - maxVal)))
+		sum += x[i]
+	}
+	for i := range x {
+		x[i] /= sum
+	}
+}
+
+func TestSpeculativeDecodeContextFull(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	draftConfig := testConfig
+	draftConfig.SeqLen = testConfig.SeqLen / 2
+	draftW := newTestWeights(draftConfig, 2)
+	emit := func(int) bool { t.Error("token emitted"); return false }
+
+	// prompt fits into context of target model, but not of draft model
+	prompt := make([]int, draftConfig.SeqLen)
+	if _, err := llama2.SpeculativeDecode(testConfig, w, draftConfig, draftW, prompt, llama2.SpeculativeOptions{DraftTokens: 4, MaxTokens: 10}, emit); err != llama2.ErrContextFull {
+		t.Errorf("draft model: got %v", err)
+	}
+	if _, err := llama2.PromptLookupDecode(testConfig, w, make([]int, testConfig.SeqLen), llama2.SpeculativeOptions{DraftTokens: 4, MaxTokens: 10}, emit); err != llama2.ErrContextFull {
+		t.Errorf("prompt lookup: got %v", err)
+	}
+}
+
+func TestSpeculativeDecodeVocabMismatch(t *testing.T) {
+	draftConfig := testConfig
+	draftConfig.VocabSize++
+	if _, err := llama2.SpeculativeDecode(testConfig, newTestWeights(testConfig, 1), draftConfig, newTestWeights(draftConfig, 1), nil, llama2.SpeculativeOptions{}, nil); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,50 @@
+package llama2
+
+import (
+	"context"
+	"errors"
+)
+
+// RunStatePool limits memory of RunStates of concurrent sessions of one model.
+// States are allocated on demand, up to as many as fit into memory budget, and reused once put back.
+// It can be used by many goroutines at once.
+type RunStatePool struct {
+	config    Config
+	free      chan RunState
+	allocated chan struct{}
+}
+
+// NewRunStatePool fits as many RunStates of config into budget bytes as possible, it fails if not even one does.
+// Buffers that Session allocates for prompt prefill are not counted.
+func NewRunStatePool(config Config, budget int) (*RunStatePool, error) {
+	n := budget / config.RunStateBytes()
+	if n < 1 {
+		return nil, errors.New("memory budget is less than one RunState")
+	}
+	return &RunStatePool{config: config, free: make(chan RunState, n), allocated: make(chan struct{}, n)}, nil
+}
+
+// Size is maximum number of RunStates.
+func (p *RunStatePool) Size() int { return cap(p.free) }
+
+// Get returns free RunState, or waits until one is put back when all are taken.
+// Once ctx is done, it returns error of ctx.
+// KV cache of returned state is not cleared, positions before pos are written by forward pass before they are read.
+func (p *RunStatePool) Get(ctx context.Context) (RunState, error) {
+	select {
+	case s := <-p.free:
+		return s, nil
+	default:
+	}
+	select {
+	case s := <-p.free:
+		return s, nil
+	case p.allocated <- struct{}{}:
+		return NewRunState(p.config), nil
+	case <-ctx.Done():
+		return RunState{}, ctx.Err()
+	}
+}
+
+// Put returns RunState taken by Get to pool, it should not be used after that.
+func (p *RunStatePool) Put(s RunState) { p.free <- s }
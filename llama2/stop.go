@@ -0,0 +1,84 @@
+package llama2
+
+import (
+	"bytes"
+	"io"
+)
+
+// StopWriter passes text to underlying writer until any of stop strings occurs in it.
+// Stop string may span multiple writes. Text that can be beginning of stop string
+// is held back until it is resolved, so stop string itself is never written.
+type StopWriter struct {
+	w       io.Writer
+	stops   [][]byte
+	held    []byte
+	stopped bool
+}
+
+func NewStopWriter(w io.Writer, stops []string) *StopWriter {
+	s := &StopWriter{w: w}
+	for _, stop := range stops {
+		if stop != "" {
+			s.stops = append(s.stops, []byte(stop))
+		}
+	}
+	return s
+}
+
+// Stopped reports whether stop string was found.
+func (s *StopWriter) Stopped() bool { return s.stopped }
+
+func (s *StopWriter) WriteString(p string) (int, error) {
+	if s.stopped {
+		return len(p), nil
+	}
+	s.held = append(s.held, p...)
+	return len(p), s.flush()
+}
+
+func (s *StopWriter) Write(p []byte) (int, error) {
+	if s.stopped {
+		return len(p), nil
+	}
+	s.held = append(s.held, p...)
+	return len(p), s.flush()
+}
+
+// flush held text that can not be part of stop string
+func (s *StopWriter) flush() error {
+	// earliest occurrence of any stop string
+	end := -1
+	for _, stop := range s.stops {
+		if i := bytes.Index(s.held, stop); i >= 0 && (end < 0 || i < end) {
+			end = i
+		}
+	}
+	if end >= 0 {
+		s.stopped = true
+		_, err := s.w.Write(s.held[:end])
+		s.held = s.held[:0]
+		return err
+	}
+
+	// longest suffix that is beginning of any stop string
+	hold := 0
+	for _, stop := range s.stops {
+		for n := min(len(stop)-1, len(s.held)); n > hold; n-- {
+			if bytes.HasSuffix(s.held, stop[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+
+	_, err := s.w.Write(s.held[:len(s.held)-hold])
+	s.held = s.held[:copy(s.held, s.held[len(s.held)-hold:])]
+	return err
+}
+
+// Flush writes held back text, when no more text is expected.
+func (s *StopWriter) Flush() error {
+	_, err := s.w.Write(s.held)
+	s.held = s.held[:0]
+	return err
+}
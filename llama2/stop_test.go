@@ -0,0 +1,114 @@
+package llama2_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestStopWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		stops     []string
+		writes    []string
+		flush     bool
+		exp       string
+		isStopped bool
+	}{
+		{
+			name:      "in one write",
+			stops:     []string{"END"},
+			writes:    []string{"abcENDdef"},
+			exp:       "abc",
+			isStopped: true,
+		},
+		{
+			name:      "across 2 writes",
+			stops:     []string{"END"},
+			writes:    []string{"abcE", "NDdef"},
+			exp:       "abc",
+			isStopped: true,
+		},
+		{
+			name:      "across 3 writes",
+			stops:     []string{"END"},
+			writes:    []string{"abcE", "N", "Ddef"},
+			exp:       "abc",
+			isStopped: true,
+		},
+		{
+			name:      "overlapping prefix",
+			stops:     []string{"aab"},
+			writes:    []string{"a", "a", "a", "b", "c"},
+			exp:       "a",
+			isStopped: true,
+		},
+		{
+			name:      "later stop string matches earlier",
+			stops:     []string{"xyz", "b"},
+			writes:    []string{"axy", "zb"},
+			exp:       "a",
+			isStopped: true,
+		},
+		{
+			name:      "earlier stop string matches earlier",
+			stops:     []string{"b", "xyz"},
+			writes:    []string{"axyzb"},
+			exp:       "a",
+			isStopped: true,
+		},
+		{
+			name:   "partial match is held back",
+			stops:  []string{"END"},
+			writes: []string{"abcEN"},
+			exp:    "abc",
+		},
+		{
+			name:   "flush after partial match",
+			stops:  []string{"END"},
+			writes: []string{"abcEN"},
+			flush:  true,
+			exp:    "abcEN",
+		},
+		{
+			name:   "partial match that does not continue",
+			stops:  []string{"END"},
+			writes: []string{"abcEN", "x"},
+			exp:    "abcENx",
+		},
+		{
+			name:      "writes after stopped",
+			stops:     []string{"END"},
+			writes:    []string{"aEND", "more", "text"},
+			flush:     true,
+			exp:       "a",
+			isStopped: true,
+		},
+		{
+			name:   "no stop strings",
+			stops:  []string{""},
+			writes: []string{"a", "b"},
+			exp:    "ab",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out strings.Builder
+			w := llama2.NewStopWriter(&out, tc.stops)
+			for _, s := range tc.writes {
+				if n, err := w.WriteString(s); err != nil || n != len(s) {
+					t.Fatal(n, err)
+				}
+			}
+			if tc.flush {
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if out.String() != tc.exp || w.Stopped() != tc.isStopped {
+				t.Errorf("got %q %v, exp %q %v", out.String(), w.Stopped(), tc.exp, tc.isStopped)
+			}
+		})
+	}
+}
@@ -1,8 +1,8 @@
 package llama2
 
 import (
+	"context"
 	"math"
-	"sync"
 
 	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
 )
@@ -25,6 +25,23 @@ type RunState struct {
 
 	KCache []float32 // (layer, seq_len, kv_dim)
 	VCache []float32 // (layer, seq_len, kv_dim)
+
+	// reusable parallel tasks, so that forward pass does not allocate
+	// (nil in RunState that is not made by NewRunState, then each forward pass allocates them)
+	tasks *transformerTasks
+}
+
+type transformerTasks struct {
+	matmul    nn.MatMulTask[float32]
+	attention attentionTask
+}
+
+// orNew returns tasks, or new ones when they are nil
+func (t *transformerTasks) orNew() *transformerTasks {
+	if t == nil {
+		return &transformerTasks{}
+	}
+	return t
 }
 
 func NewRunState(config Config) RunState {
@@ -41,9 +58,22 @@ func NewRunState(config Config) RunState {
 		Logits: make([]float32, config.VocabSize),
 		KCache: make([]float32, (config.NumLayers * config.SeqLen * config.KVDim())),
 		VCache: make([]float32, (config.NumLayers * config.SeqLen * config.KVDim())),
+		tasks:  &transformerTasks{},
 	}
 }
 
+// CopyKVCache copies keys and values of positions before pos into dst of same config, e.g. to fork sequence.
+func (s RunState) CopyKVCache(dst RunState, pos int, config Config) {
+	kvDim := config.KVDim()
+	for l := 0; l < config.NumLayers; l++ {
+		loff := l * config.SeqLen * kvDim
+		copy(dst.KCache[loff:loff+pos*kvDim], s.KCache[loff:loff+pos*kvDim])
+		copy(dst.VCache[loff:loff+pos*kvDim], s.VCache[loff:loff+pos*kvDim])
+	}
+}
+
+// TransformerWeights are only read by forward pass, so one instance can be used by many goroutines at once,
+// each with its own RunState. Parallel steps of their forward passes share worker pool.
 type TransformerWeights struct {
 	TokenEmbeddingTable []float32 // (vocab_size, dim)
 
@@ -73,56 +103,55 @@ type TransformerWeights struct {
 	// (optional) classifier weights for the logits on the last layer
 
 	WCLS []float32 // (vocab_size, dim)
+
+	// (optional) long-lived workers that run parallel steps of forward pass with these weights
+
+	Pool *nn.Pool
+}
+
+// pool of weights, or pool shared by all weights without own one, which is sized from GOMAXPROCS
+func (w TransformerWeights) pool() *nn.Pool {
+	if w.Pool == nil {
+		return nn.DefaultPool()
+	}
+	return w.Pool
 }
 
 func Transformer(token int, pos int, config Config, s RunState, w TransformerWeights) {
-	var wg sync.WaitGroup
+	TransformerContext(context.Background(), token, pos, config, s, w)
+}
 
+// TransformerContext is Transformer that stops before next layer once ctx is done, returning its error.
+// Then KV cache at pos is partially written, and the token should be forwarded again.
+func TransformerContext(ctx context.Context, token int, pos int, config Config, s RunState, w TransformerWeights) error {
 	// a few convenience variables
 	x := s.X
 	dim := config.Dim
 	kvDim := config.KVDim()
-	kvMul := config.KVMul()
 	hiddenDim := config.HiddenDim
-	headSize := config.HeadSize()
+	tasks := s.tasks.orNew()
+	matmul := &tasks.matmul
+	pool := w.pool()
 
 	copy(x, w.TokenEmbeddingTable[token*dim:(token+1)*dim])
 
 	// forward all layers
 	for l := 0; l < config.NumLayers; l++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		nn.RMSNorm(s.XB, x, w.RMSAttentionWeight[l*dim:((l+1)*dim)])
 
 		// Q,K,V matmuls for this position
-		wg.Add(3)
-		go func() { nn.MatMul(s.Q, s.XB, w.WQ[l*dim*dim:(l+1)*dim*dim]); wg.Done() }()
-		go func() { nn.MatMul(s.K, s.XB, w.WK[l*dim*kvDim:(l+1)*dim*kvDim]); wg.Done() }()
-		go func() { nn.MatMul(s.V, s.XB, w.WV[l*dim*kvDim:(l+1)*dim*kvDim]); wg.Done() }()
-		wg.Wait()
+		matmul.MatMul(pool, s.XB,
+			s.Q, w.WQ[l*dim*dim:(l+1)*dim*dim],
+			s.K, w.WK[l*dim*kvDim:(l+1)*dim*kvDim],
+			s.V, w.WV[l*dim*kvDim:(l+1)*dim*kvDim],
+		)
 
 		// RoPE relative positional encoding: complex-valued rotate q and k in each head
-		for i := 0; i+1 < dim; i += 2 {
-			headDim := i % headSize
-			freq := 1.0 / math.Pow(10000, float64(headDim)/float64(headSize))
-			val := float64(pos) * freq
-			fcr := float32(math.Cos(val))
-			fci := float32(math.Sin(val))
-
-			// how many vectors? 2 = q & k, 1 = q only
-			rotN := 1
-			if i < kvDim {
-				rotN = 2
-			}
-
-			for v := 0; v < rotN; v++ {
-				vec := s.K
-				if v == 0 {
-					vec = s.Q
-				}
-				v0, v1 := vec[i], vec[i+1]
-				vec[i] = v0*fcr - v1*fci
-				vec[i+1] = v0*fci + v1*fcr
-			}
-		}
+		rope(s.Q, s.K, pos, config)
 
 		// save key and val at this time step (pos) to cache
 		loff := l * config.SeqLen * kvDim
@@ -130,47 +159,12 @@ func Transformer(token int, pos int, config Config, s RunState, w TransformerWei
 		copy(s.VCache[(loff+pos*kvDim):(loff+(pos+1)*kvDim)], s.V)
 
 		// multihead attention. iterate over all heads
-		// Notes on llama2.c: pragma here, using goroutines
-		wg.Add(config.NumHeads)
-		for h := 0; h < config.NumHeads; h++ {
-			go func(h int) {
-				defer wg.Done()
-
-				// get the query vector for this head
-				q := s.Q[(h * headSize):((h + 1) * headSize)]
-				// attention scores for this head
-				att := s.Att[(h * config.SeqLen):((h + 1) * config.SeqLen)]
-				// iterate over all timesteps, including the current one
-				for t := 0; t <= pos; t++ {
-					// get the key vector for this head and at this timestamp
-					k := s.KCache[(loff + t*kvDim + (h/kvMul)*headSize):(loff + t*kvDim + ((h+1)/kvMul)*headSize)]
-					// calculate the attention score as the dot product of q and k
-					var score float32
-					for i := 0; i < headSize; i++ {
-						score += q[i] * k[i]
-					}
-					score /= float32(math.Sqrt(float64(headSize)))
-					// save the score to the attention buffer
-					att[t] = score
-				}
-
-				// scores to get attention weights, from 0..pos inclusively
-				nn.SoftMax(att[:pos+1])
-
-				// weighted sum of the values, store back into xb
-				clear(s.XB[(h * headSize):((h + 1) * headSize)])
-				for t := 0; t <= pos; t++ {
-					a := att[t]
-					for i := 0; i < headSize; i++ {
-						s.XB[((h * headSize) + i)] += a * s.VCache[loff+t*kvDim+(h/kvMul)*headSize+i]
-					}
-				}
-			}(h)
-		}
-		wg.Wait()
+		// Notes on llama2.c: pragma here, using pool
+		tasks.attention = attentionTask{q: s.Q, att: s.Att, xb: s.XB, seq: batchPositions{s: s, pos: pos}, config: config, loff: loff}
+		pool.Run(&tasks.attention, config.NumHeads)
 
 		// final matmul to get the output of the attention
-		nn.MatMul(s.XB2, s.XB, w.WO[l*dim*dim:(l+1)*dim*dim])
+		matmul.MatMul(pool, s.XB, s.XB2, w.WO[l*dim*dim:(l+1)*dim*dim])
 
 		// residual connection back into x
 		nn.Acc(x, s.XB2)
@@ -180,10 +174,10 @@ func Transformer(token int, pos int, config Config, s RunState, w TransformerWei
 
 		// Now for FFN in PyTorch we have: self.w2(F.silu(self.w1(x)) * self.w3(x))
 		// first calculate self.w1(x) and self.w3(x)
-		wg.Add(2)
-		go func() { nn.MatMul(s.HB, s.XB, w.W1[l*dim*hiddenDim:(l+1)*dim*hiddenDim]); wg.Done() }()
-		go func() { nn.MatMul(s.HB2, s.XB, w.W3[l*dim*hiddenDim:(l+1)*dim*hiddenDim]); wg.Done() }()
-		wg.Wait()
+		matmul.MatMul(pool, s.XB,
+			s.HB, w.W1[l*dim*hiddenDim:(l+1)*dim*hiddenDim],
+			s.HB2, w.W3[l*dim*hiddenDim:(l+1)*dim*hiddenDim],
+		)
 
 		// F.silu; silu(x)=x*σ, where σ(x) is the logistic sigmoid
 		for i := 0; i < hiddenDim; i++ {
@@ -196,7 +190,7 @@ func Transformer(token int, pos int, config Config, s RunState, w TransformerWei
 		}
 
 		// final matmul to get the output of the FFN
-		nn.MatMul(s.XB, s.HB, w.W2[l*dim*hiddenDim:(l+1)*dim*hiddenDim])
+		matmul.MatMul(pool, s.HB, s.XB, w.W2[l*dim*hiddenDim:(l+1)*dim*hiddenDim])
 
 		// residual connection
 		nn.Acc(x, s.XB)
@@ -206,5 +200,84 @@ func Transformer(token int, pos int, config Config, s RunState, w TransformerWei
 	nn.RMSNorm(x, x, w.RMSFinalWeight)
 
 	// classifier into logits
-	nn.MatMul(s.Logits, x, w.WCLS)
+	matmul.MatMul(pool, x, s.Logits, w.WCLS)
+	return nil
+}
+
+// rope rotates q and k in each head by angles of position.
+func rope(q, k []float32, pos int, config Config) {
+	headSize := config.HeadSize()
+	kvDim := config.KVDim()
+	for i := 0; i+1 < config.Dim; i += 2 {
+		headDim := i % headSize
+		freq := 1.0 / math.Pow(10000, float64(headDim)/float64(headSize))
+		val := float64(pos) * freq
+		fcr := float32(math.Cos(val))
+		fci := float32(math.Sin(val))
+
+		// how many vectors? 2 = q & k, 1 = q only
+		rotN := 1
+		if i < kvDim {
+			rotN = 2
+		}
+
+		for v := 0; v < rotN; v++ {
+			vec := k
+			if v == 0 {
+				vec = q
+			}
+			v0, v1 := vec[i], vec[i+1]
+			vec[i] = v0*fcr - v1*fci
+			vec[i+1] = v0*fci + v1*fcr
+		}
+	}
+}
+
+// attentionTask computes multihead attention of one layer for positions of batch.
+// Chunk is head of one of positions, queries, scores and outputs of positions follow one another.
+type attentionTask struct {
+	q, att, xb []float32
+	seq        batchPositions
+	config     Config
+	loff       int
+}
+
+func (task *attentionTask) Run(chunk int) {
+	config, loff := task.config, task.loff
+	kvDim := config.KVDim()
+	kvMul := config.KVMul()
+	headSize := config.HeadSize()
+	i, h := chunk/config.NumHeads, chunk%config.NumHeads
+	s, pos := task.seq.at(i)
+	xb := task.xb[i*config.Dim : (i+1)*config.Dim]
+
+	// get the query vector for this head
+	q := task.q[(i*config.Dim + h*headSize):(i*config.Dim + (h+1)*headSize)]
+	// attention scores for this head
+	att := task.att[(chunk * config.SeqLen):((chunk + 1) * config.SeqLen)]
+	// iterate over all timesteps, including the current one
+	for t := 0; t <= pos; t++ {
+		// get the key vector for this head and at this timestamp
+		k := s.KCache[(loff + t*kvDim + (h/kvMul)*headSize):(loff + t*kvDim + (h/kvMul+1)*headSize)]
+		// calculate the attention score as the dot product of q and k
+		var score float32
+		for i := 0; i < headSize; i++ {
+			score += q[i] * k[i]
+		}
+		score /= float32(math.Sqrt(float64(headSize)))
+		// save the score to the attention buffer
+		att[t] = score
+	}
+
+	// scores to get attention weights, from 0..pos inclusively
+	nn.SoftMax(att[:pos+1])
+
+	// weighted sum of the values, store back into xb
+	clear(xb[(h * headSize):((h + 1) * headSize)])
+	for t := 0; t <= pos; t++ {
+		a := att[t]
+		for i := 0; i < headSize; i++ {
+			xb[((h * headSize) + i)] += a * s.VCache[loff+t*kvDim+(h/kvMul)*headSize+i]
+		}
+	}
 }
@@ -0,0 +1,321 @@
+package llama2_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+var testConfig = llama2.Config{
+	Dim:        16,
+	HiddenDim:  32,
+	NumLayers:  2,
+	NumHeads:   4,
+	NumKVHeads: 2,
+	VocabSize:  64,
+	SeqLen:     128,
+}
+
+func fillRand(x []float32, rnd *rand.Rand) {
+	for i := range x {
+		x[i] = float32(rnd.NormFloat64()) / 2
+	}
+}
+
+func newTestWeights(config llama2.Config, seed int64) llama2.TransformerWeights {
+	rnd := rand.New(rand.NewSource(seed))
+	headSize := config.HeadSize()
+	w := llama2.TransformerWeights{
+		TokenEmbeddingTable: make([]float32, (config.VocabSize * config.Dim)),
+		RMSAttentionWeight:  make([]float32, (config.NumLayers * config.Dim)),
+		RMSFFNWeight:        make([]float32, (config.NumLayers * config.Dim)),
+		RMSFinalWeight:      make([]float32, config.Dim),
+		WQ:                  make([]float32, (config.NumLayers * config.Dim * config.NumHeads * headSize)),
+		WK:                  make([]float32, (config.NumLayers * config.Dim * config.NumKVHeads * headSize)),
+		WV:                  make([]float32, (config.NumLayers * config.Dim * config.NumKVHeads * headSize)),
+		WO:                  make([]float32, (config.NumLayers * config.NumHeads * headSize * config.Dim)),
+		W1:                  make([]float32, (config.NumLayers * config.Dim * config.HiddenDim)),
+		W2:                  make([]float32, (config.NumLayers * config.HiddenDim * config.Dim)),
+		W3:                  make([]float32, (config.NumLayers * config.Dim * config.HiddenDim)),
+	}
+	for _, x := range [][]float32{w.TokenEmbeddingTable, w.RMSAttentionWeight, w.RMSFFNWeight, w.RMSFinalWeight, w.WQ, w.WK, w.WV, w.WO, w.W1, w.W2, w.W3} {
+		fillRand(x, rnd)
+	}
+	w.WCLS = w.TokenEmbeddingTable
+	return w
+}
+
+func TestDecodeNoAllocs(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	s := llama2.NewRunState(testConfig)
+
+	processors := llama2.LogitsProcessors{
+		llama2.LogitBias{0: -100, 5: 2},
+		&llama2.Penalties{Window: 16, Repetition: 1.1, Frequency: 0.1, Presence: 0.1},
+		llama2.NewNGramBlocker(3),
+		llama2.Temperature(0.9),
+		&llama2.LogitsSnapshot{},
+		llama2.TopK(40),
+		llama2.TailFree(0.95),
+		llama2.Typical(0.95),
+		llama2.Eta(0.0009),
+		llama2.MinP(0.05),
+		llama2.TopP(0.9),
+	}
+	sampler := llama2.RandomSampler{}
+
+	history := make([]int, 0, testConfig.SeqLen)
+	token, pos := 1, 0
+	step := func() {
+		if pos == testConfig.SeqLen {
+			token, pos, history = 1, 0, history[:0]
+		}
+		llama2.Transformer(token, pos, testConfig, s, w)
+		processors.Process(history, s.Logits)
+		token = sampler.Sample(s.Logits)
+		history = append(history, token)
+		pos++
+	}
+
+	// warm up reusable buffers
+	for i := 0; i < testConfig.SeqLen; i++ {
+		step()
+	}
+
+	if allocs := testing.AllocsPerRun(testConfig.SeqLen, step); allocs != 0 {
+		t.Errorf("decoding step allocates %f times", allocs)
+	}
+}
+
+func TestTransformerStructLiteral(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	expected := llama2.NewRunState(testConfig)
+	n := llama2.NewRunState(testConfig)
+	s := llama2.RunState{X: n.X, XB: n.XB, XB2: n.XB2, HB: n.HB, HB2: n.HB2, Q: n.Q, K: n.K, V: n.V, Att: n.Att, Logits: n.Logits, KCache: n.KCache, VCache: n.VCache}
+	nb := llama2.NewBatchRunState(testConfig, 2)
+	b := llama2.BatchRunState{X: nb.X, XB: nb.XB, XB2: nb.XB2, HB: nb.HB, HB2: nb.HB2, Q: nb.Q, K: nb.K, V: nb.V, Att: nb.Att, Logits: nb.Logits}
+
+	llama2.TransformerBatch([]int{1, 5}, 0, testConfig, s, b, w)
+	llama2.Transformer(17, 2, testConfig, s, w)
+	for pos, token := range []int{1, 5, 17} {
+		llama2.Transformer(token, pos, testConfig, expected, w)
+	}
+	if !slices.Equal(expected.Logits, s.Logits) {
+		t.Errorf("got %v, exp %v", s.Logits, expected.Logits)
+	}
+}
+
+func TestTransformerBatch(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	tokens := []int{1, 5, 17, 3, 42, 8, 9, 60, 2, 11}
+
+	s := llama2.NewRunState(testConfig)
+	var expected [][]float32
+	for pos, token := range tokens {
+		llama2.Transformer(token, pos, testConfig, s, w)
+		expected = append(expected, slices.Clone(s.Logits))
+	}
+
+	// prefix is forwarded token by token, the rest in batches
+	for _, prefix := range []int{0, 1, 4} {
+		for _, batch := range []int{1, 3, len(tokens)} {
+			t.Run(fmt.Sprintf("prefix_%d_batch_%d", prefix, batch), func(t *testing.T) {
+				s := llama2.NewRunState(testConfig)
+				b := llama2.NewBatchRunState(testConfig, batch)
+				for pos := 0; pos < prefix; pos++ {
+					llama2.Transformer(tokens[pos], pos, testConfig, s, w)
+				}
+				for pos := prefix; pos < len(tokens); pos += batch {
+					n := min(batch, len(tokens)-pos)
+					llama2.TransformerBatch(tokens[pos:pos+n], pos, testConfig, s, b, w)
+					for i := 0; i < n; i++ {
+						if got := b.Logits[i*testConfig.VocabSize : (i+1)*testConfig.VocabSize]; !slices.Equal(expected[pos+i], got) {
+							t.Errorf("pos %d: got %v, exp %v", pos+i, got, expected[pos+i])
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTransformerPrefill(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	tokens := []int{1, 5, 17, 3, 42, 8, 9, 60, 2, 11}
+
+	expected := llama2.NewRunState(testConfig)
+	for pos, token := range tokens {
+		llama2.Transformer(token, pos, testConfig, expected, w)
+	}
+
+	for _, batch := range []int{1, 3, len(tokens)} {
+		t.Run(fmt.Sprintf("batch_%d", batch), func(t *testing.T) {
+			s := llama2.NewRunState(testConfig)
+			llama2.Transformer(tokens[0], 0, testConfig, s, w)
+			if err := llama2.TransformerPrefill(context.Background(), tokens[1:], 1, testConfig, s, llama2.NewBatchRunState(testConfig, batch), w); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(expected.Logits, s.Logits) {
+				t.Errorf("got %v, exp %v", s.Logits, expected.Logits)
+			}
+			if !slices.Equal(expected.KCache, s.KCache) || !slices.Equal(expected.VCache, s.VCache) {
+				t.Error("KV cache differs")
+			}
+		})
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s := llama2.NewRunState(testConfig)
+		if err := llama2.TransformerPrefill(ctx, tokens, 0, testConfig, s, llama2.NewBatchRunState(testConfig, 4), w); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v", err)
+		}
+	})
+}
+
+func TestTransformerMulti(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	prompts := [][]int{{1, 5, 17}, {1}, {1, 42, 8, 9, 60, 2, 11}}
+
+	// prompts without the last token are forwarded separately, sequences are of different lengths
+	states := make([]llama2.RunState, len(prompts))
+	expected := make([]llama2.RunState, len(prompts))
+	tokens := make([]int, len(prompts))
+	positions := make([]int, len(prompts))
+	for i, prompt := range prompts {
+		states[i], expected[i] = llama2.NewRunState(testConfig), llama2.NewRunState(testConfig)
+		for pos, token := range prompt[:len(prompt)-1] {
+			llama2.Transformer(token, pos, testConfig, states[i], w)
+			llama2.Transformer(token, pos, testConfig, expected[i], w)
+		}
+		tokens[i], positions[i] = prompt[len(prompt)-1], len(prompt)-1
+	}
+
+	b := llama2.NewBatchRunState(testConfig, len(prompts))
+	for step := 0; step < 10; step++ {
+		llama2.TransformerMulti(tokens, positions, testConfig, states, b, w)
+		for i, s := range states {
+			llama2.Transformer(tokens[i], positions[i], testConfig, expected[i], w)
+			if !slices.Equal(expected[i].Logits, s.Logits) {
+				t.Fatalf("step %d sequence %d: got %v, exp %v", step, i, s.Logits, expected[i].Logits)
+			}
+			tokens[i] = (llama2.GreedySampler{}).Sample(s.Logits)
+			positions[i]++
+		}
+	}
+}
+
+func TestTransformerMultiInvalid(t *testing.T) {
+	w := newTestWeights(testConfig, 1)
+	s := llama2.NewRunState(testConfig)
+	b := llama2.NewBatchRunState(testConfig, 2)
+	for _, tc := range []struct {
+		name      string
+		tokens    []int
+		positions []int
+		states    []llama2.RunState
+	}{
+		{name: "positions", tokens: []int{1, 1}, positions: []int{0}, states: []llama2.RunState{s, s}},
+		{name: "states", tokens: []int{1, 1}, positions: []int{0, 0}, states: []llama2.RunState{s}},
+		{name: "capacity", tokens: []int{1, 1, 1}, positions: []int{0, 0, 0}, states: []llama2.RunState{s, s, s}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("expected panic")
+				}
+			}()
+			llama2.TransformerMulti(tc.tokens, tc.positions, testConfig, tc.states, b, w)
+		})
+	}
+}
+
+// benchmarkConfig is of stories15M
+var benchmarkConfig = llama2.Config{
+	Dim:        288,
+	HiddenDim:  768,
+	NumLayers:  6,
+	NumHeads:   6,
+	NumKVHeads: 6,
+	VocabSize:  32000,
+	SeqLen:     256,
+}
+
+func BenchmarkPrefill(b *testing.B) {
+	w := newTestWeights(benchmarkConfig, 1)
+	s := llama2.NewRunState(benchmarkConfig)
+	tokens := make([]int, 128)
+	for i := range tokens {
+		tokens[i] = i
+	}
+
+	b.Run("token_by_token", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for pos, token := range tokens {
+				llama2.Transformer(token, pos, benchmarkConfig, s, w)
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		batch := llama2.NewBatchRunState(benchmarkConfig, 64)
+		for i := 0; i < b.N; i++ {
+			llama2.TransformerPrefill(context.Background(), tokens, 0, benchmarkConfig, s, batch, w)
+		}
+	})
+}
+
+func BenchmarkTransformerMulti(b *testing.B) {
+	w := newTestWeights(benchmarkConfig, 1)
+	for _, n := range []int{1, 4, 16} {
+		states := make([]llama2.RunState, n)
+		for i := range states {
+			states[i] = llama2.NewRunState(benchmarkConfig)
+		}
+		tokens, positions := make([]int, n), make([]int, n)
+		for i := range tokens {
+			tokens[i], positions[i] = i, i
+		}
+
+		b.Run(fmt.Sprintf("sequences_%d/one_by_one", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j, s := range states {
+					llama2.Transformer(tokens[j], positions[j], benchmarkConfig, s, w)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("sequences_%d/batch", n), func(b *testing.B) {
+			batch := llama2.NewBatchRunState(benchmarkConfig, n)
+			for i := 0; i < b.N; i++ {
+				llama2.TransformerMulti(tokens, positions, benchmarkConfig, states, batch, w)
+			}
+		})
+	}
+}
+
+// BenchmarkTransformerThreads decodes with small models on pools of several sizes.
+// Pool is compared to goroutines for each step by BenchmarkMatMulScheduling of nnfast.
+func BenchmarkTransformerThreads(b *testing.B) {
+	for _, config := range []llama2.Config{testConfig, benchmarkConfig} {
+		m := llama2.Model{Config: config, Weights: newTestWeights(config, 1)}
+		s := llama2.NewRunState(config)
+		for _, threads := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("dim_%d/threads_%d", config.Dim, threads), func(b *testing.B) {
+				// pool of previous run is closed
+				m.SetThreads(threads)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					llama2.Transformer(i%config.VocabSize, i%config.SeqLen, config, s, m.Weights)
+				}
+			})
+		}
+		m.Weights.Pool.Close()
+	}
+}
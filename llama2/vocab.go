@@ -2,8 +2,11 @@ package llama2
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
+	"strconv"
+	"strings"
 )
 
 type Vocab struct {
@@ -48,11 +51,19 @@ func (v Vocab) EncodeWord(s string) int {
 }
 
 func (v Vocab) Encode(s string) (tokens []int) {
+	tokens, err := v.encode(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tokens
+}
+
+func (v Vocab) encode(s string) (tokens []int, err error) {
 	// first encode every individual byte in the input string
 	for i := 0; i < len(s); i++ {
 		id := v.EncodeWord(string(s[i : i+1]))
 		if id == -1 {
-			log.Fatalf("bad token(%v)", string(s[i:i+1]))
+			return nil, fmt.Errorf("bad token(%v)", string(s[i:i+1]))
 		}
 		tokens = append(tokens, id)
 	}
@@ -80,5 +91,70 @@ func (v Vocab) Encode(s string) (tokens []int) {
 		tokens = tokens[:len(tokens)-1]
 	}
 
-	return tokens
+	return tokens, nil
+}
+
+// Decode token that follows prev token to text, with byte fallback tokens like <0x0A> converted to their byte.
+func (v Vocab) Decode(prev, token int) string {
+	if b, ok := byteFallback(v.Words[token]); ok {
+		return string([]byte{b})
+	}
+	if prev == 1 {
+		return followingBOS(v.Words[token])
+	}
+	return v.Words[token]
+}
+
+// TokenBytes is text of token, with byte fallback tokens like <0x0A> converted to their byte.
+// Control tokens <unk> (0), BOS (1) and EOS (2) have no text.
+func (v Vocab) TokenBytes(token int) []byte { return v.tokenBytes(0, token) }
+
+// tokenBytes is TokenBytes of token that follows prev token, same as Decode.
+func (v Vocab) tokenBytes(prev, token int) []byte {
+	if token <= 2 {
+		return nil
+	}
+	return []byte(v.Decode(prev, token))
+}
+
+// byteFallback is byte of token like <0x0A>, that sentencepiece uses for bytes not in vocabulary.
+func byteFallback(word string) (byte, bool) {
+	if len(word) != 6 || !strings.HasPrefix(word, "<0x") || word[5] != '>' {
+		return 0, false
+	}
+	b, err := strconv.ParseUint(word[3:5], 16, 8)
+	return byte(b), err == nil
+}
+
+// followingBOS is text of token that follows BOS (1) token, sentencepiece decoder strips its leading whitespace.
+func followingBOS(text string) string {
+	if len(text) > 0 && text[0] == ' ' {
+		return text[1:]
+	}
+	return text
+}
+
+// isFollowingBOS reports whether token at i of history, which does not include starting BOS (1) token, follows BOS.
+func isFollowingBOS(history []int, i int) bool { return i == 0 || history[i-1] == 1 }
+
+// TokenIDs converts text to token ids. Number is token id, exact vocabulary word is its token,
+// otherwise text is encoded into multiple tokens.
+func (v Vocab) TokenIDs(s string) ([]int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		if id < 0 || id >= len(v.Words) {
+			return nil, fmt.Errorf("token id(%d) is out of vocabulary", id)
+		}
+		return []int{id}, nil
+	}
+	if id := v.EncodeWord(s); id != -1 {
+		return []int{id}, nil
+	}
+	tokens, err := v.encode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens for text(%s)", s)
+	}
+	return tokens, nil
 }
@@ -0,0 +1,32 @@
+package llama2_test
+
+import (
+	"testing"
+
+	"github.com/nikolaydubina/llama2.go/llama2"
+)
+
+func TestVocabDecode(t *testing.T) {
+	vocab := llama2.Vocab{Words: []string{"<unk>", "\n<s>\n", "\n</s>\n", " a", "b", "<0x0A>", "<0x20>", "<0xZZ>"}}
+	tests := []struct {
+		prev, token int
+		text        string
+		bytes       string
+	}{
+		{prev: 4, token: 3, text: " a", bytes: " a"},
+		{prev: 1, token: 3, text: "a", bytes: " a"},
+		{prev: 1, token: 4, text: "b", bytes: "b"},
+		{prev: 4, token: 5, text: "\n", bytes: "\n"},
+		{prev: 1, token: 6, text: " ", bytes: " "},
+		{prev: 4, token: 7, text: "<0xZZ>", bytes: "<0xZZ>"},
+		{prev: 4, token: 2, text: "\n</s>\n", bytes: ""},
+	}
+	for _, tc := range tests {
+		if text := vocab.Decode(tc.prev, tc.token); text != tc.text {
+			t.Errorf("decode %d after %d: got %q, exp %q", tc.token, tc.prev, text, tc.text)
+		}
+		if b := vocab.TokenBytes(tc.token); string(b) != tc.bytes {
+			t.Errorf("bytes of %d: got %q, exp %q", tc.token, b, tc.bytes)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"time"
 
-	nn "github.com/nikolaydubina/llama2.go/exp/nnfast"
 	"github.com/nikolaydubina/llama2.go/llama2"
 )
 
@@ -18,6 +23,38 @@ func main() {
 		steps              int
 		prompt             string
 		topp               float64
+		topk               int
+		minp               float64
+		typicalp           float64
+		tfsz               float64
+		eta                float64
+		penaltyWindow      int
+		repeatPenalty      float64
+		frequencyPenalty   float64
+		presencePenalty    float64
+		noRepeatNGramSize  int
+		logitBias          []string
+		bannedTokens       []string
+		stops              []string
+		logprobs           int
+		mirostat           bool
+		mirostatTau        float64
+		mirostatEta        float64
+		beamWidth          int
+		lengthPenalty      float64
+		earlyStopping      bool
+		grammarFilePath    string
+		jsonSchemaFilePath string
+		regex              string
+		draftFilePath      string
+		draftTokens        int
+		promptLookup       int
+		negativePrompt     string
+		cfgScale           float64
+		contrastiveK       int
+		penaltyAlpha       float64
+		threads            int
+		sessionFilePath    string
 	)
 
 	flag.StringVar(&checkpointFilePath, "checkpoint", "out/model.bin", "checkpoint binary file with weights")
@@ -25,101 +62,354 @@ func main() {
 	flag.Float64Var(&temperature, "temperature", 0.9, "temperature (optional; 0 = deterministic argmax sampling; 1 = baseline)")
 	flag.IntVar(&steps, "steps", 256, "max number of steps to run for, 0: use seq_len")
 	flag.Float64Var(&topp, "topp", 0.9, "top-p in nucleus sampling (1.0 = off; 0.9 works well, but slower)")
+	flag.IntVar(&topk, "topk", 0, "top-k sampling, keep only k most likely tokens (0 = off)")
+	flag.Float64Var(&minp, "minp", 0, "min-p sampling, keep only tokens with probability at least min-p times of most likely token (0 = off)")
+	flag.Float64Var(&typicalp, "typicalp", 1.0, "locally typical sampling, keep tokens closest to entropy up to this probability mass (1.0 = off)")
+	flag.Float64Var(&tfsz, "tfsz", 1.0, "tail-free sampling, cut tail where second derivative of sorted probabilities exceeds z (1.0 = off)")
+	flag.Float64Var(&eta, "eta", 0, "eta sampling, keep tokens with probability above min(eta, sqrt(eta) * exp(-entropy)) (0 = off; 0.0009 works well)")
 	flag.StringVar(&prompt, "prompt", "", "query to start with")
+	flag.StringVar(&negativePrompt, "negative-prompt", "", "prompt to guide generation away from with classifier-free guidance (empty = unconditional)")
+	flag.Float64Var(&cfgScale, "cfg-scale", 1.0, "classifier-free guidance scale, logits are uncond + scale * (cond - uncond) (1.0 = off; 1.5 works well)")
+	flag.IntVar(&penaltyWindow, "penalty-window", 64, "number of most recent tokens to apply penalties to (0 = all)")
+	flag.Float64Var(&repeatPenalty, "repeat-penalty", 1.0, "CTRL-style repetition penalty for recent tokens (1.0 = off; 1.1 works well)")
+	flag.Float64Var(&frequencyPenalty, "frequency-penalty", 0, "penalty subtracted from logit for each occurrence of recent token (0 = off)")
+	flag.Float64Var(&presencePenalty, "presence-penalty", 0, "penalty subtracted from logit of any recent token (0 = off)")
+	flag.Func("logit-bias", "token:bias added to logit of token, token is token id or text (repeatable)", func(s string) error { logitBias = append(logitBias, s); return nil })
+	flag.Func("ban", "token id or text to never generate (repeatable)", func(s string) error { bannedTokens = append(bannedTokens, s); return nil })
+	flag.Func("stop", "stop generation before this text, it is not printed (repeatable)", func(s string) error { stops = append(stops, s); return nil })
+	flag.BoolVar(&mirostat, "mirostat", false, "use Mirostat v2 sampling instead of top-k, min-p and top-p")
+	flag.Float64Var(&mirostatTau, "mirostat-tau", 5.0, "Mirostat target surprise, in bits")
+	flag.Float64Var(&mirostatEta, "mirostat-eta", 0.1, "Mirostat learning rate")
+	flag.IntVar(&beamWidth, "beams", 0, "beam search with this many beams, prints best hypotheses with scores instead of sampling (0 = off)")
+	flag.Float64Var(&lengthPenalty, "length-penalty", 1.0, "beam search score is sum of log-probabilities divided by length^length-penalty")
+	flag.BoolVar(&earlyStopping, "early-stopping", false, "beam search stops as soon as there are enough finished hypotheses")
+	flag.StringVar(&grammarFilePath, "grammar", "", "file with GBNF-like grammar that generated text must follow (optional)")
+	flag.StringVar(&jsonSchemaFilePath, "json-schema", "", "file with JSON Schema that generated JSON must match (optional)")
+	flag.StringVar(&regex, "regex", "", "regular expression that whole generated text must match (optional)")
+	flag.StringVar(&draftFilePath, "draft-checkpoint", "", "checkpoint of smaller draft model with same tokenizer for speculative decoding (optional)")
+	flag.IntVar(&draftTokens, "draft-tokens", 4, "number of tokens draft model proposes for each pass of model in speculative decoding")
+	flag.IntVar(&promptLookup, "prompt-lookup", 0, "speculative decoding with tokens that followed earlier occurrence of up to this many last tokens as draft, no draft model needed (0 = off)")
+	flag.IntVar(&contrastiveK, "contrastive-k", 0, "contrastive search among this many most likely tokens instead of sampling (0 = off; 4 works well)")
+	flag.Float64Var(&penaltyAlpha, "penalty-alpha", 0.6, "contrastive search weight of degeneration penalty (0 = greedy)")
+	flag.IntVar(&logprobs, "logprobs", 0, "print log-probability, entropy and top N alternatives of each generated token as JSONL instead of text (0 = off)")
+	flag.IntVar(&noRepeatNGramSize, "no-repeat-ngram-size", 0, "never generate n-gram of this size that is already in context (0 = off)")
+	flag.IntVar(&threads, "threads", 0, "number of goroutines that run forward pass in parallel (0 = GOMAXPROCS)")
+	flag.StringVar(&sessionFilePath, "session", "", "file with context and KV cache, generation continues it if file exists and saves it after (optional)")
 	flag.Parse()
 
-	checkpointFile, err := os.OpenFile(checkpointFilePath, os.O_RDONLY, 0)
-	if err != nil {
-		log.Fatal(err)
+	// flags set explicitly, to reject ones that mode of generation ignores
+	isSet := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+
+	// only sampling runs in session, other modes keep their own context
+	if sessionFilePath != "" && (beamWidth > 0 || contrastiveK > 0 || draftFilePath != "" || promptLookup > 0) {
+		log.Fatal("-session can not be used with beam search, contrastive search or speculative decoding")
 	}
-	defer checkpointFile.Close()
 
-	out := os.Stdout
+	var out io.Writer = os.Stdout
+	if logprobs > 0 {
+		out = io.Discard
+	}
+	logprobsOut := json.NewEncoder(os.Stdout)
 
-	config, err := llama2.NewConfigFromCheckpoint(checkpointFile)
+	model, err := llama2.LoadModel(checkpointFilePath, tokenizerFilePath)
 	if err != nil {
-		log.Fatalf("cannot read config: %s", err)
+		log.Fatal(err)
 	}
+	if threads > 0 {
+		model.SetThreads(threads)
+	}
+	config, w, vocab := model.Config, model.Weights, model.Vocab
 	log.Printf("config: %#v\n", config)
 
-	// "negative vocab size is hacky way of signaling unsahred weights. biy yikes" — @karpathy
-	isSharedWeights := config.VocabSize > 0
-	if config.VocabSize < 0 {
-		config.VocabSize = -config.VocabSize
+	// right now we cannot run for more than config.SeqLen steps
+	if steps <= 0 || steps > config.SeqLen {
+		steps = config.SeqLen
 	}
 
-	tokenizerFile, err := os.OpenFile(tokenizerFilePath, os.O_RDONLY, 0)
-	if err != nil {
-		log.Fatal(err)
+	promptTokens := vocab.Encode(prompt)
+
+	penalties := &llama2.Penalties{
+		Window:     penaltyWindow,
+		Repetition: float32(repeatPenalty),
+		Frequency:  float32(frequencyPenalty),
+		Presence:   float32(presencePenalty),
 	}
-	defer tokenizerFile.Close()
 
-	vocab := llama2.NewVocabFromFile(config.VocabSize, tokenizerFile)
+	bias := llama2.LogitBias{}
+	for _, s := range logitBias {
+		if err := bias.Set(vocab, s); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, s := range bannedTokens {
+		if err := bias.Ban(vocab, s); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	w := llama2.NewTransformerWeightsFromCheckpoint(config, checkpointFile, isSharedWeights)
+	if beamWidth > 0 {
+		// beams do not share history and are not sampled, so only stateless processors apply
+		for _, name := range []string{"temperature", "topp", "topk", "minp", "typicalp", "tfsz", "eta", "mirostat", "no-repeat-ngram-size", "grammar", "json-schema", "regex", "draft-checkpoint", "prompt-lookup", "negative-prompt", "cfg-scale", "contrastive-k", "logprobs", "stop"} {
+			if isSet[name] {
+				log.Fatalf("beam search can not be used with -%s, only with -logit-bias, -ban and penalties", name)
+			}
+		}
 
-	// right now we cannot run for more than config.SeqLen steps
-	if steps <= 0 || steps > config.SeqLen {
-		steps = config.SeqLen
+		timeStart := time.Now()
+		hypotheses, err := llama2.BeamSearch(config, w, promptTokens, llama2.BeamSearchOptions{
+			Width:         beamWidth,
+			LengthPenalty: float32(lengthPenalty),
+			EarlyStopping: earlyStopping,
+			MaxTokens:     steps - len(promptTokens),
+			Processors:    llama2.LogitsProcessors{bias, penalties},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("beam search took: %s\n", time.Since(timeStart))
+		for _, h := range hypotheses {
+			text := prompt
+			prev := 1
+			if len(promptTokens) > 0 {
+				prev = promptTokens[len(promptTokens)-1]
+			}
+			for _, token := range h.Tokens {
+				text += vocab.Decode(prev, token)
+				prev = token
+			}
+			fmt.Fprintf(out, "%f\t%f\t%q\n", h.Score, h.LogProb, text)
+		}
+		return
 	}
 
-	runState := llama2.NewRunState(config)
+	// generated text goes through stop strings, prompt is written as is
+	generatedOut := llama2.NewStopWriter(out, stops)
 
-	promptTokens := vocab.Encode(prompt)
+	// logits after temperature, for log-probabilities
+	logprobsLogits := &llama2.LogitsSnapshot{}
 
-	// the current position we are in
-	timeStart := time.Now()
-	var token int = 1 // 1 = BOS token in llama-2 sentencepiece
-	var pos = 0
-	for pos < steps {
-		// forward the transformer to get logits for the next token
-		llama2.Transformer(token, pos, config, runState, w)
-
-		var next int
-		if pos < len(promptTokens) {
-			next = promptTokens[pos]
-		} else {
-			// sample the next token
-			if temperature == 0 {
-				// greedy argmax sampling
-				next = nn.ArgMax(runState.Logits)
-			} else {
-				// apply the temperature to the logits
-				for q := 0; q < config.VocabSize; q++ {
-					runState.Logits[q] /= float32(temperature)
-				}
-				// apply softmax to the logits to the probabilities for next token
-				nn.SoftMax(runState.Logits)
-				// we now want to sample from this distribution to get the next token
-				if topp <= 0 || topp >= 1 {
-					// simply sample from the predicted probability distribution
-					next = nn.Sample(runState.Logits)
-				} else {
-					// top-p (nucleus) sampling, clamping the least likely tokens to zero
-					next = nn.SampleTopP(runState.Logits, float32(topp))
-				}
+	// processors of logits in fixed order: guidance, bias, penalties, temperature, truncations
+	var processors llama2.LogitsProcessors
+	if cfgScale != 1 {
+		processors = append(processors, llama2.NewClassifierFreeGuidance(config, w, vocab.Encode(negativePrompt), float32(cfgScale)))
+	}
+	processors = append(processors, bias, penalties)
+	if noRepeatNGramSize > 0 {
+		processors = append(processors, llama2.NewNGramBlocker(noRepeatNGramSize))
+	}
+
+	if grammarFilePath != "" {
+		grammarText, err := os.ReadFile(grammarFilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grammar, err := llama2.ParseGrammar(string(grammarText))
+		if err != nil {
+			log.Fatal(err)
+		}
+		processors = append(processors, llama2.NewGrammarProcessor(grammar, vocab))
+	}
+
+	if jsonSchemaFilePath != "" {
+		schema, err := os.ReadFile(jsonSchemaFilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grammar, err := llama2.JSONSchemaGrammar(schema)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processors = append(processors, llama2.NewGrammarProcessor(grammar, vocab))
+	}
+
+	if regex != "" {
+		re, err := llama2.CompileRegex(regex, vocab)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processors = append(processors, llama2.NewRegexProcessor(re))
+	}
+
+	isSpeculative := draftFilePath != "" || promptLookup > 0
+	if isSpeculative && (noRepeatNGramSize > 0 || cfgScale != 1 || grammarFilePath != "" || jsonSchemaFilePath != "" || regex != "" || mirostat || logprobs > 0) {
+		log.Fatal("speculative decoding supports only processors that do not keep state between tokens")
+	}
+
+	if contrastiveK > 0 {
+		// candidates are picked deterministically, so sampling flags do not apply
+		for _, name := range []string{"temperature", "topp", "topk", "minp", "typicalp", "tfsz", "eta", "mirostat", "mirostat-tau", "mirostat-eta", "draft-checkpoint", "draft-tokens", "prompt-lookup", "logprobs"} {
+			if isSet[name] {
+				log.Fatalf("contrastive search can not be used with -%s, only with processors of logits and -stop", name)
 			}
 		}
-		pos++
+		prev := 1
+		for _, token := range promptTokens {
+			io.WriteString(out, vocab.Decode(prev, token))
+			prev = token
+		}
+
+		timeStart := time.Now()
+		generated := 0
+		llama2.ContrastiveSearch(config, w, promptTokens, llama2.ContrastiveOptions{
+			TopK:       contrastiveK,
+			Alpha:      float32(penaltyAlpha),
+			MaxTokens:  steps - len(promptTokens),
+			Processors: processors,
+		}, func(token int) bool {
+			generated++
+			generatedOut.WriteString(vocab.Decode(prev, token))
+			prev = token
+			return !generatedOut.Stopped()
+		})
+		generatedOut.Flush()
+		out.Write([]byte("\n"))
 
-		// data-dependent terminating condition: the BOS (1) token delimits sequences
-		if next == 1 {
-			break
+		log.Printf("achieved tok/s: %f\n", float64(generated)/time.Since(timeStart).Seconds())
+		return
+	}
+
+	var sampler llama2.Sampler
+	switch {
+	case temperature == 0:
+		// greedy argmax sampling
+		processors = append(processors, logprobsLogits)
+		sampler = llama2.GreedySampler{}
+	case mirostat:
+		// perplexity-controlled sampling, adapting to each step
+		processors = append(processors, llama2.Temperature(temperature), logprobsLogits)
+		sampler = llama2.NewMirostat(float32(mirostatTau), float32(mirostatEta))
+	default:
+		processors = append(processors, llama2.Temperature(temperature), logprobsLogits)
+		// truncate distribution in fixed order: top-k, tail-free, typical, eta, min-p, top-p
+		if topk > 0 {
+			processors = append(processors, llama2.TopK(topk))
+		}
+		if tfsz > 0 && tfsz < 1 {
+			processors = append(processors, llama2.TailFree(float32(tfsz)))
+		}
+		if typicalp > 0 && typicalp < 1 {
+			processors = append(processors, llama2.Typical(float32(typicalp)))
+		}
+		if eta > 0 {
+			processors = append(processors, llama2.Eta(float32(eta)))
+		}
+		if minp > 0 {
+			processors = append(processors, llama2.MinP(float32(minp)))
+		}
+		if topp > 0 && topp < 1 {
+			// top-p (nucleus) sampling, clamping the least likely tokens to zero
+			processors = append(processors, llama2.TopP(float32(topp)))
+		}
+		// sample from the predicted probability distribution
+		sampler = llama2.RandomSampler{}
+	}
+
+	if isSpeculative {
+		prev := 1
+		for _, token := range promptTokens {
+			io.WriteString(out, vocab.Decode(prev, token))
+			prev = token
+		}
+		emit := func(token int) bool {
+			generatedOut.WriteString(vocab.Decode(prev, token))
+			prev = token
+			return !generatedOut.Stopped()
+		}
+		opts := llama2.SpeculativeOptions{
+			DraftTokens: draftTokens,
+			MaxTokens:   steps - len(promptTokens),
+			Greedy:      temperature == 0,
+			Processors:  processors,
+			NGram:       promptLookup,
 		}
 
-		// following BOS (1) token, sentencepiece decoder strips any leading whitespace
-		var tokenStr string
-		if token == 1 && vocab.Words[next][0] == ' ' {
-			tokenStr = vocab.Words[next][1:]
+		timeStart := time.Now()
+		var stats llama2.SpeculativeStats
+		if draftFilePath != "" {
+			var draft *llama2.Model
+			if draft, err = llama2.LoadModel(draftFilePath, tokenizerFilePath); err != nil {
+				log.Fatal(err)
+			}
+			draft.Weights.Pool = model.Weights.Pool
+			log.Printf("draft config: %#v\n", draft.Config)
+			timeStart = time.Now()
+			stats, err = llama2.SpeculativeDecode(config, w, draft.Config, draft.Weights, promptTokens, opts, emit)
 		} else {
-			tokenStr = vocab.Words[next]
+			stats, err = llama2.PromptLookupDecode(config, w, promptTokens, opts, emit)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		generatedOut.Flush()
+		out.Write([]byte("\n"))
+
+		log.Printf("achieved tok/s: %f\n", float64(stats.Generated)/time.Since(timeStart).Seconds())
+		log.Printf("speculative decoding: accepted %d of %d drafted tokens (%.1f%%), %.2f tokens per pass of model\n",
+			stats.Accepted, stats.Drafted, 100*float64(stats.Accepted)/float64(max(stats.Drafted, 1)), float64(stats.Generated)/float64(max(stats.TargetPasses, 1)))
+		return
+	}
+
+	// Ctrl+C stops generation, but not statistics
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	session := llama2.NewSession(model)
+	if sessionFilePath != "" {
+		if f, err := os.Open(sessionFilePath); err == nil {
+			err = session.Load(f)
+			f.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("session: continuing %d tokens from %s\n", len(session.Tokens()), sessionFilePath)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Fatal(err)
 		}
-		out.WriteString(tokenStr)
+	}
 
-		// advance forward
-		token = next
+	// restored context counts against steps, so that generated tokens fit into context
+	maxTokens := steps - len(session.Tokens()) - len(promptTokens)
+	if maxTokens <= 0 {
+		log.Fatalf("session of %d tokens and prompt of %d tokens leave no room for -steps %d", len(session.Tokens()), len(promptTokens), steps)
+	}
+
+	stats, err := session.Generate(ctx, prompt, llama2.GenerateOptions{
+		MaxTokens:  maxTokens,
+		Processors: processors,
+		Sampler:    sampler,
+		Stop:       stops,
+		Output:     out,
+		EchoPrompt: true,
+		OnToken: func(token llama2.Token) error {
+			if logprobs == 0 {
+				return nil
+			}
+			lp := llama2.NewLogProbs(logprobsLogits.Logits, token.ID, logprobs)
+			lp.Text = vocab.Words[lp.Token]
+			for i := range lp.Top {
+				lp.Top[i].Text = vocab.Words[lp.Top[i].Token]
+			}
+			return logprobsOut.Encode(lp)
+		},
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
 	}
 	out.Write([]byte("\n"))
 
-	log.Printf("achieved tok/s: %f\n", float64(pos-1)/time.Since(timeStart).Seconds())
+	log.Printf("achieved tok/s: %f\n", stats.TokensPerSecond())
+
+	if sessionFilePath != "" {
+		f, err := os.Create(sessionFilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := session.Save(f); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
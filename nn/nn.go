@@ -1,8 +1,10 @@
 package nn
 
 import (
+	"cmp"
 	"math"
 	"math/rand"
+	"slices"
 )
 
 func Acc[T float32 | float64](a, b []T) {
@@ -61,7 +63,11 @@ func MatMul[T float32 | float64](xout, x, w []T) {
 
 // Sample index from probabilities, they must sum to 1
 func Sample[T float32 | float64](probabilities []T) int {
-	r := T(rand.Float32())
+	return SampleWith(probabilities, T(rand.Float32()))
+}
+
+// SampleWith samples index from probabilities with uniform random number r in [0, 1)
+func SampleWith[T float32 | float64](probabilities []T, r T) int {
 	var cdf T
 	for i, p := range probabilities {
 		cdf += p
@@ -81,3 +87,173 @@ func ArgMax[T float32 | float64](v []T) int {
 	}
 	return maxi
 }
+
+// TopK keeps only probabilities of k most likely tokens and renormalizes them.
+// Tokens with the same probability as k-th most likely token are kept as well.
+func TopK[T float32 | float64](probabilities []T, k int) {
+	if k <= 0 || k >= len(probabilities) {
+		return
+	}
+	sorted := slices.Clone(probabilities)
+	slices.Sort(sorted)
+	slices.Reverse(sorted)
+	threshold := sorted[k-1]
+	for i, p := range probabilities {
+		if p < threshold {
+			probabilities[i] = 0
+		}
+	}
+	normalize(probabilities)
+}
+
+// MinP keeps only probabilities that are at least minp fraction of the most likely token and renormalizes them.
+func MinP[T float32 | float64](probabilities []T, minp T) {
+	if minp <= 0 {
+		return
+	}
+	threshold := slices.Max(probabilities) * minp
+	for i, p := range probabilities {
+		if p < threshold {
+			probabilities[i] = 0
+		}
+	}
+	normalize(probabilities)
+}
+
+// TailFree keeps i most likely tokens, where i is the first index at which cumulative normalized absolute
+// second derivative of sorted probabilities exceeds z, same as llama.cpp. At least one token is kept.
+func TailFree[T float32 | float64](probabilities []T, z T) {
+	if z <= 0 || z >= 1 {
+		return
+	}
+	var sorted []int
+	for i, p := range probabilities {
+		if p > 0 {
+			sorted = append(sorted, i)
+		}
+	}
+	slices.SortStableFunc(sorted, func(a, b int) int { return cmp.Compare(probabilities[b], probabilities[a]) })
+	if len(sorted) <= 2 {
+		return
+	}
+
+	d := make([]T, len(sorted)-2)
+	var sum T
+	for i := range d {
+		d[i] = T(math.Abs(float64(probabilities[sorted[i]] - 2*probabilities[sorted[i+1]] + probabilities[sorted[i+2]])))
+		sum += d[i]
+	}
+	if sum == 0 {
+		return
+	}
+
+	kept := len(sorted)
+	var cumulative T
+	for i := range d {
+		cumulative += d[i] / sum
+		if cumulative > z && i >= 1 {
+			kept = i
+			break
+		}
+	}
+	for _, i := range sorted[kept:] {
+		probabilities[i] = 0
+	}
+	normalize(probabilities)
+}
+
+// TopP keeps the smallest set of most likely tokens with cumulative probability exceeding topp.
+func TopP[T float32 | float64](probabilities []T, topp T) {
+	if topp <= 0 || topp >= 1 {
+		return
+	}
+	sorted := sortedIndices(probabilities, func(p T) T { return -p })
+	var cumulative T
+	for i, j := range sorted {
+		cumulative += probabilities[j]
+		if cumulative > topp {
+			for _, j := range sorted[i+1:] {
+				probabilities[j] = 0
+			}
+			break
+		}
+	}
+	normalize(probabilities)
+}
+
+// Typical keeps tokens, whose surprise is closest to entropy of distribution,
+// until their cumulative probability reaches mass.
+func Typical[T float32 | float64](probabilities []T, mass T) {
+	if mass <= 0 || mass >= 1 {
+		return
+	}
+	var h float64
+	for _, p := range probabilities {
+		if p > 0 {
+			h -= float64(p) * math.Log(float64(p))
+		}
+	}
+	sorted := sortedIndices(probabilities, func(p T) T { return T(math.Abs(-math.Log(float64(p)) - h)) })
+	var cumulative T
+	for i, j := range sorted {
+		cumulative += probabilities[j]
+		if cumulative >= mass {
+			for _, j := range sorted[i+1:] {
+				probabilities[j] = 0
+			}
+			break
+		}
+	}
+	normalize(probabilities)
+}
+
+// Eta keeps tokens with probability above min(eta, sqrt(eta) * exp(-entropy)) and the most likely token.
+func Eta[T float32 | float64](probabilities []T, eta T) {
+	if eta <= 0 {
+		return
+	}
+	var h float64
+	for _, p := range probabilities {
+		if p > 0 {
+			h -= float64(p) * math.Log(float64(p))
+		}
+	}
+	epsilon := min(eta, T(math.Sqrt(float64(eta))*math.Exp(-h)))
+	maxi := ArgMax(probabilities)
+	for i, p := range probabilities {
+		if p <= epsilon && i != maxi {
+			probabilities[i] = 0
+		}
+	}
+	normalize(probabilities)
+}
+
+// sortedIndices of non-zero probabilities in ascending order of key
+func sortedIndices[T float32 | float64](probabilities []T, key func(p T) T) (sorted []int) {
+	for i, p := range probabilities {
+		if p > 0 {
+			sorted = append(sorted, i)
+		}
+	}
+	slices.SortStableFunc(sorted, func(a, b int) int { return cmp.Compare(key(probabilities[a]), key(probabilities[b])) })
+	return sorted
+}
+
+// Truncator has same API as optimized one, its methods call functions of this package.
+type Truncator[T float32 | float64] struct{}
+
+func (Truncator[T]) TopK(probabilities []T, k int)     { TopK(probabilities, k) }
+func (Truncator[T]) TopP(probabilities []T, topp T)    { TopP(probabilities, topp) }
+func (Truncator[T]) Typical(probabilities []T, mass T) { Typical(probabilities, mass) }
+func (Truncator[T]) TailFree(probabilities []T, z T)   { TailFree(probabilities, z) }
+func (Truncator[T]) Eta(probabilities []T, eta T)      { Eta(probabilities, eta) }
+
+func normalize[T float32 | float64](probabilities []T) {
+	var sum T
+	for _, p := range probabilities {
+		sum += p
+	}
+	for i := range probabilities {
+		probabilities[i] /= sum
+	}
+}
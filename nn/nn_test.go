@@ -2,6 +2,7 @@ package nn_test
 
 import (
 	"fmt"
+	"math"
 	"slices"
 	"testing"
 
@@ -98,3 +99,152 @@ func TestMatMul(t *testing.T) {
 		})
 	}
 }
+
+func TestTopK(t *testing.T) {
+	tests := []struct {
+		x   []float32
+		k   int
+		exp []float32
+	}{
+		{
+			x:   []float32{0.1, 0.2, 0.3, 0.4},
+			k:   2,
+			exp: []float32{0, 0, 0.4285714, 0.57142854},
+		},
+		{
+			x:   []float32{0.25, 0.25, 0.25, 0.25},
+			k:   1,
+			exp: []float32{0.25, 0.25, 0.25, 0.25},
+		},
+		{
+			x:   []float32{0.1, 0.2, 0.3, 0.4},
+			k:   0,
+			exp: []float32{0.1, 0.2, 0.3, 0.4},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d: %#v", i, tc), func(t *testing.T) {
+			nn.TopK(tc.x, tc.k)
+			if !slices.Equal(tc.exp, tc.x) {
+				t.Errorf("got %v, exp %v", tc.x, tc.exp)
+			}
+		})
+	}
+}
+
+func TestMinP(t *testing.T) {
+	tests := []struct {
+		x    []float32
+		minp float32
+		exp  []float32
+	}{
+		{
+			x:    []float32{0.1, 0.2, 0.3, 0.4},
+			minp: 0.5,
+			exp:  []float32{0, 0.22222224, 0.33333334, 0.44444448},
+		},
+		{
+			x:    []float32{0.1, 0.2, 0.3, 0.4},
+			minp: 0,
+			exp:  []float32{0.1, 0.2, 0.3, 0.4},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d: %#v", i, tc), func(t *testing.T) {
+			nn.MinP(tc.x, tc.minp)
+			if !slices.Equal(tc.exp, tc.x) {
+				t.Errorf("got %v, exp %v", tc.x, tc.exp)
+			}
+		})
+	}
+}
+
+func TestTailFree(t *testing.T) {
+	tests := []struct {
+		x    []float32
+		z    float32
+		kept int
+	}{
+		// normalized absolute second derivatives are 0, 0.25, 0.75
+		{x: []float32{0.05, 0.4, 0.2, 0.3, 0.05}, z: 0.5, kept: 2},
+		{x: []float32{0.05, 0.4, 0.2, 0.3, 0.05}, z: 0.1, kept: 1},
+		{x: []float32{0.05, 0.4, 0.2, 0.3, 0.05}, z: 0.99, kept: 2},
+		{x: []float32{0.05, 0.4, 0.2, 0.3, 0.05}, z: 1, kept: 5},
+		{x: []float32{0.5, 0.5}, z: 0.5, kept: 2},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d: %#v", i, tc), func(t *testing.T) {
+			nn.TailFree(tc.x, tc.z)
+			kept := 0
+			for _, p := range tc.x {
+				if p > 0 {
+					kept++
+				}
+			}
+			if kept != tc.kept {
+				t.Errorf("kept %d, exp %d: %v", kept, tc.kept, tc.x)
+			}
+		})
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	x := []float32{0.1, 0.2, 0.3, 0.4}
+	tests := []struct {
+		name     string
+		truncate func(x []float32)
+		kept     []int
+	}{
+		{name: "top-p", truncate: func(x []float32) { nn.TopP(x, 0.5) }, kept: []int{2, 3}},
+		{name: "top-p most likely", truncate: func(x []float32) { nn.TopP(x, 0.3) }, kept: []int{3}},
+		{name: "top-p off", truncate: func(x []float32) { nn.TopP(x, 1) }, kept: []int{0, 1, 2, 3}},
+		// entropy is 1.28, surprises are 2.30, 1.61, 1.20, 0.92
+		{name: "typical", truncate: func(x []float32) { nn.Typical(x, 0.4) }, kept: []int{1, 2}},
+		{name: "typical closest to entropy", truncate: func(x []float32) { nn.Typical(x, 0.2) }, kept: []int{2}},
+		{name: "typical most", truncate: func(x []float32) { nn.Typical(x, 0.85) }, kept: []int{1, 2, 3}},
+		// threshold is min(eta, sqrt(eta) * 0.278)
+		{name: "eta", truncate: func(x []float32) { nn.Eta(x, 0.25) }, kept: []int{1, 2, 3}},
+		{name: "eta large", truncate: func(x []float32) { nn.Eta(x, 0.9) }, kept: []int{2, 3}},
+		{name: "eta small", truncate: func(x []float32) { nn.Eta(x, 0.01) }, kept: []int{0, 1, 2, 3}},
+		{name: "truncator", truncate: func(x []float32) { nn.Truncator[float32]{}.TopP(x, 0.5) }, kept: []int{2, 3}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			x := slices.Clone(x)
+			tc.truncate(x)
+			var kept []int
+			var sum float32
+			for i, p := range x {
+				if p > 0 {
+					kept = append(kept, i)
+				}
+				sum += p
+			}
+			if !slices.Equal(tc.kept, kept) {
+				t.Errorf("kept %v, exp %v: %v", kept, tc.kept, x)
+			}
+			if math.Abs(float64(sum-1)) > 1e-6 {
+				t.Errorf("sum %v", sum)
+			}
+		})
+	}
+}
+
+func TestMatMulTask(t *testing.T) {
+	w1 := []float32{1, 2, 3, 1, 5, 1}
+	w2 := []float32{2, 0, 0, 0, 1, 0, 0, 0, 1}
+	x := []float32{1, 2, 3, 4, 5, 6}
+
+	out1, out2 := make([]float32, 4), make([]float32, 6)
+	var task nn.MatMulTask[float32]
+	task.MatMulBatch(nn.NewPool(4), 2, x, out1, w1, out2, w2)
+
+	exp1, exp2 := make([]float32, 4), make([]float32, 6)
+	for b := 0; b < 2; b++ {
+		nn.MatMul(exp1[b*2:(b+1)*2], x[b*3:(b+1)*3], w1)
+		nn.MatMul(exp2[b*3:(b+1)*3], x[b*3:(b+1)*3], w2)
+	}
+	if !slices.Equal(exp1, out1) || !slices.Equal(exp2, out2) {
+		t.Errorf("got %v %v, exp %v %v", out1, out2, exp1, exp2)
+	}
+}
@@ -0,0 +1,47 @@
+package nn
+
+// Task is parallel work split into chunks.
+type Task interface {
+	Run(chunk int)
+}
+
+// Pool has same API as optimized one, but it runs all chunks sequentially by caller.
+type Pool struct {
+	size int
+}
+
+func NewPool(size int) *Pool { return &Pool{size: max(size, 1)} }
+
+var defaultPool = NewPool(1)
+
+// DefaultPool is shared by everyone without own pool.
+func DefaultPool() *Pool { return defaultPool }
+
+func (p *Pool) Size() int { return p.size }
+
+// Run chunks [0, n) of task one after another.
+func (p *Pool) Run(task Task, n int) {
+	for i := 0; i < n; i++ {
+		task.Run(i)
+	}
+}
+
+func (p *Pool) Close() {}
+
+// MatMulTask computes W (d,n) @ x (n,) -> xout (d,) of several matrices that share x.
+type MatMulTask[T float32 | float64] struct{}
+
+// MatMul computes pairs of xout and w for same x.
+func (t *MatMulTask[T]) MatMul(pool *Pool, x []T, xoutw ...[]T) { t.MatMulBatch(pool, 1, x, xoutw...) }
+
+// MatMulBatch computes pairs of xout (batch,d) and w (d,n) for same x (batch,n), one vector at a time.
+func (t *MatMulTask[T]) MatMulBatch(pool *Pool, batch int, x []T, xoutw ...[]T) {
+	n := len(x) / batch
+	for i := 0; i+1 < len(xoutw); i += 2 {
+		xout, w := xoutw[i], xoutw[i+1]
+		d := len(xout) / batch
+		for b := 0; b < batch; b++ {
+			MatMul(xout[b*d:(b+1)*d], x[b*n:(b+1)*n], w)
+		}
+	}
+}